@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+
+	ch "github.com/jnormington/clubhouse-go"
+)
+
+// How checklists above the threshold are migrated
+const (
+	checklistToSubStories = "sub-stories"
+	checklistToEpic       = "epic"
+)
+
+func (co *ClubhouseOptions) promptUserForLargeChecklists(cards *[]Card) error {
+	var largest int
+	for _, c := range *cards {
+		for _, n := range checklistSizes(&c) {
+			if n > largest {
+				largest = n
+			}
+		}
+	}
+
+	if largest == 0 {
+		return nil
+	}
+
+	threshold, err := promptUserForNumber(fmt.Sprintf("The largest checklist has %d items\n"+
+		"Please type the number of items above which a checklist is no longer imported as tasks (0 keeps all as tasks)", largest))
+	if err != nil {
+		return err
+	}
+
+	if threshold <= 0 || threshold >= largest {
+		return nil
+	}
+
+	co.ChecklistThreshold = threshold
+
+	opts := []string{
+		"Linked sub-stories of the card story",
+		"An epic containing the card story and a story for each item",
+	}
+
+	i, err := ui.Select("How should the checklists above the threshold be imported?", opts)
+	if err != nil {
+		return err
+	}
+
+	co.ChecklistMode = checklistToSubStories
+	if i == 1 {
+		co.ChecklistMode = checklistToEpic
+	}
+
+	co.ChecklistDoneState, err = co.promptUserForWorkflowState("Please select the workflow state for the completed checklist items")
+	return err
+}
+
+// checklistSizes returns the number of items of each checklist by
+// its id, as a card can have several checklists with the same name
+func checklistSizes(card *Card) map[string]int {
+	sizes := map[string]int{}
+
+	for _, t := range card.Tasks {
+		sizes[t.ChecklistID]++
+	}
+
+	return sizes
+}
+
+// isLargeChecklist returns whether the checklist is above the
+// threshold and is imported as stories instead of tasks
+func isLargeChecklist(card *Card, checklistID string, opts *ClubhouseOptions) bool {
+	if opts.ChecklistThreshold == 0 {
+		return false
+	}
+
+	return checklistSizes(card)[checklistID] > opts.ChecklistThreshold
+}
+
+func hasLargeChecklist(card *Card, opts *ClubhouseOptions) bool {
+	for _, t := range card.Tasks {
+		if isLargeChecklist(card, t.ChecklistID, opts) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// createChecklistEpic creates the epic for the stories of the large
+// checklists and moves the created card story into it
+func createChecklistEpic(storyID int64, ps *PlannedStory, opts *ClubhouseOptions) (*int64, error) {
+	e, err := opts.ClubhouseEntry.CreateEpic(ch.CreateEpic{
+		Name:        ps.CardName,
+		Description: fmt.Sprintf("Checklists imported from Trello: %s", ps.TrelloURL),
+		CreatedAt:   ps.Story.CreatedAt,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	opts.Run.RecordEpic(e.ID)
+
+	body := map[string]int64{"epic_id": e.ID}
+	if err := doClubhouseRequest("PUT", fmt.Sprintf("/stories/%d", storyID), body, nil); err != nil {
+		return &e.ID, fmt.Errorf("adding the story to the checklist epic: %s", err)
+	}
+
+	return &e.ID, nil
+}
+
+// buildChecklistStories builds a story for every item of the large checklists
+func buildChecklistStories(card *Card, opts *ClubhouseOptions, um *UserMap) []ch.CreateStory {
+	var stories []ch.CreateStory
+
+	for _, t := range card.Tasks {
+		if !isLargeChecklist(card, t.ChecklistID, opts) {
+			continue
+		}
+
+		stateID := opts.State.ID
+		if t.Completed {
+			stateID = opts.ChecklistDoneState.ID
+		}
+
+		owners := []string{}
+		if t.IDOwner != "" {
+			owners = append(owners, um.GetCreator(t.IDOwner))
+		}
+
+		stories = append(stories, ch.CreateStory{
+			ProjectID:       opts.Project.ID,
+			WorkflowStateID: stateID,
+			RequestedByID:   um.GetCreator(card.IDCreator),
+			OwnerIds:        owners,
+			StoryType:       opts.StoryType,
+			FollowerIds:     []string{},
+			FileIds:         []int64{},
+			Name:            t.Name,
+			Description:     fmt.Sprintf("Checklist '%s' item from Trello: %s", t.Checklist, card.ShortURL),
+			CreatedAt:       card.CreatedAt,
+			Deadline:        t.DueDate,
+			Labels:          []ch.CreateLabel{{Name: t.Checklist}},
+			Tasks:           []ch.CreateTask{},
+			Comments:        []ch.CreateComment{},
+		})
+	}
+
+	return stories
+}
+
+// createChecklistStories creates the planned checklist item stories, linking
+// them to the card story or adding them to the card story epic.
+// It returns the number of stories created and any errors
+func createChecklistStories(parentID int64, epicID *int64, ps *PlannedStory, opts *ClubhouseOptions) (int, []error) {
+	var created int
+	var errs []error
+
+	for _, cs := range ps.ChecklistStories {
+		if opts.ChecklistMode == checklistToEpic {
+			cs.EpicID = epicID
+		}
+
+		st, err := opts.ClubhouseEntry.CreateStory(cs)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("checklist item %s: %s", cs.Name, err))
+			continue
+		}
+
+		created++
+		opts.Run.RecordStory(st.ID)
+
+		if opts.ChecklistMode == checklistToSubStories {
+			link := map[string]interface{}{
+				"subject_id": st.ID,
+				"object_id":  parentID,
+				"verb":       "relates to",
+			}
+
+			if err := doClubhouseRequest("POST", "/story-links", link, nil); err != nil {
+				errs = append(errs, fmt.Errorf("linking checklist item %s: %s", cs.Name, err))
+			}
+		}
+	}
+
+	return created, errs
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+const clubhouseAPIURL = "https://api.clubhouse.io/api/v3"
+
+// doClubhouseRequest calls the Clubhouse REST api directly for the resources
+// the clubhouse package doesn't expose, decoding the json response into v
+func doClubhouseRequest(method, path string, body interface{}, v interface{}) error {
+	var buf bytes.Buffer
+
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, clubhouseAPIURL+path, &buf)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Clubhouse-Token", clubHouseToken)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("clubhouse api returned %s for %s %s", resp.Status, method, path)
+	}
+
+	if v == nil {
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -2,19 +2,46 @@ package main
 
 import (
 	"fmt"
-	"log"
+	"strconv"
+	"strings"
 
 	ch "github.com/jnormington/clubhouse-go"
+	trello "github.com/jnormington/go-trello"
 )
 
 //ClubhouseOptions stores the options selected by the user
 type ClubhouseOptions struct {
 	Project                  *ch.Project
 	State                    *ch.State
-	ClubhouseEntry           *ch.Clubhouse
+	ClubhouseEntry           *ch.Clubhouse `json:"-"`
 	StoryType                string
 	AddCommentWithTrelloLink bool
 	ImportMember             *ch.Member
+	LabelEpics               map[string]int64
+	RemoveEpicLabels         bool
+	ListEpics                map[string]int64
+	ListStates               map[string]ListState
+	LabelColorNames          map[string]string
+	ExistingLabels           []ch.Label
+	ArchivedState            *ch.State
+	CustomFieldTargets       map[string]CustomFieldTarget
+	ClubhouseCustomFields    []clubhouseCustomField
+	ChecklistThreshold       int
+	ChecklistMode            string
+	ChecklistDoneState       *ch.State
+	DueCompleteState         *ch.State
+	DropCompletedDeadline    bool
+	ReportFormat             string
+	Run                      *RunLog `json:"-"`
+	sel                      *Selection
+}
+
+const archivedLabel = "archived-in-trello"
+
+// ListState is the workflow state chosen for the cards of a trello list
+type ListState struct {
+	ListName string
+	State    *ch.State
 }
 
 type worfklowState struct {
@@ -23,95 +50,271 @@ type worfklowState struct {
 	DisplayText string
 }
 
-// ListMember makes the call to Clubhouse package for the list
-// of members. And fails hard if an err occurs.
-func (co *ClubhouseOptions) ListMembers() *[]ch.Member {
+// ListMembers makes the call to Clubhouse package for the list of members
+func (co *ClubhouseOptions) ListMembers() (*[]ch.Member, error) {
 	u, err := co.ClubhouseEntry.ListMembers()
-
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("retrieving clubhouse members: %s", err)
 	}
 
-	return &u
+	return &u, nil
 }
 
 // SetupClubhouseOptions calls all the functions which consist of questions
-// for building ClubhouseOptions and returns a pointer to ClubhouseOptions instance
-func SetupClubhouseOptions() *ClubhouseOptions {
+// for building ClubhouseOptions and returns a pointer to ClubhouseOptions instance.
+// The project and state are only asked for when not already given in the selection
+func SetupClubhouseOptions(cards *[]Card, lists []trello.List, sel *Selection) (*ClubhouseOptions, error) {
 	var co ClubhouseOptions
 
+	co.sel = sel
+
 	co.ClubhouseEntry = ch.New(clubHouseToken)
+	co.LabelEpics = make(map[string]int64)
+	co.ListEpics = make(map[string]int64)
+	co.ListStates = make(map[string]ListState)
+	co.LabelColorNames = make(map[string]string)
+	co.CustomFieldTargets = make(map[string]CustomFieldTarget)
+
+	withCards := func(f func(*[]Card) error) func() error {
+		return func() error { return f(cards) }
+	}
+
+	steps := []func() error{
+		co.getProjectsAndPromptUser,
+		co.getWorkflowStatesAndPromptUser,
+		func() error { return co.promptUserForListStates(lists) },
+		co.getMembersAndPromptUser,
+		co.promptUserForStoryType,
+		co.promptUserIfAddCommentWithTrelloLink,
+		co.getExistingLabels,
+		withCards(co.promptUserForLabelColorNames),
+		withCards(co.getEpicsAndPromptUserForLabelMapping),
+		withCards(co.promptUserForArchivedCards),
+		withCards(co.promptUserForDueCompleteCards),
+		withCards(co.getCustomFieldsAndPromptUser),
+		withCards(co.promptUserForLargeChecklists),
+		co.promptUserForReportFormat,
+	}
+
+	for _, step := range steps {
+		if err := step(); err != nil {
+			return nil, err
+		}
+	}
+
+	return &co, nil
+}
+
+// CreateLabelEpics creates the new epics the user chose for
+// label mappings, which are stored with an epic id of 0. When
+// resuming a run the epics it already created are reused
+func (co *ClubhouseOptions) CreateLabelEpics() error {
+	var created []ch.Epic
+
+	if len(co.Run.Epics) > 0 {
+		epics, err := co.ClubhouseEntry.ListEpics()
+		if err != nil {
+			return fmt.Errorf("querying the clubhouse epics: %s", err)
+		}
+
+		for _, e := range epics {
+			if co.Run.HasEpic(e.ID) {
+				created = append(created, e)
+			}
+		}
+	}
+
+	for l, id := range co.LabelEpics {
+		if id != 0 {
+			continue
+		}
+
+		if e := findEpicByName(created, l); e != nil {
+			co.LabelEpics[l] = e.ID
+			continue
+		}
+
+		e, err := co.ClubhouseEntry.CreateEpic(ch.CreateEpic{Name: l})
+		if err != nil {
+			return fmt.Errorf("creating epic for label %s: %s", l, err)
+		}
+
+		co.Run.RecordEpic(e.ID)
+		co.LabelEpics[l] = e.ID
+	}
+
+	return nil
+}
+
+// CreateListEpics creates an epic for each of the selected trello lists
+// reusing an existing epic if one already has the same name as the list
+func (co *ClubhouseOptions) CreateListEpics(lists []trello.List, boardName, boardURL string) error {
+	epics, err := co.ClubhouseEntry.ListEpics()
+	if err != nil {
+		return fmt.Errorf("querying the clubhouse epics: %s", err)
+	}
+
+	for _, l := range lists {
+		if e := findEpicByName(epics, l.Name); e != nil {
+			co.ListEpics[l.Id] = e.ID
+			continue
+		}
 
-	co.getProjectsAndPromptUser()
-	co.getWorkflowStatesAndPromptUser()
-	co.getMembersAndPromptUser()
-	co.promptUserForStoryType()
-	co.promptUserIfAddCommentWithTrelloLink()
+		e, err := co.ClubhouseEntry.CreateEpic(ch.CreateEpic{
+			Name:        l.Name,
+			Description: fmt.Sprintf("Imported from the Trello list '%s' on the board '%s'\n%s", l.Name, boardName, boardURL),
+			CreatedAt:   createdAtFromTrelloID(l.Id),
+		})
+		if err != nil {
+			return fmt.Errorf("creating epic for list %s: %s", l.Name, err)
+		}
+
+		co.Run.RecordEpic(e.ID)
+		co.ListEpics[l.Id] = e.ID
+	}
 
-	return &co
+	return nil
 }
 
-func (co *ClubhouseOptions) promptUserIfAddCommentWithTrelloLink() {
-	fmt.Println("Would you like a comment added with the original trello ticket link?")
-	for i, b := range yesNoOpts {
-		fmt.Printf("[%d] %s\n", i, b)
+func findEpicByName(epics []ch.Epic, name string) *ch.Epic {
+	for i, e := range epics {
+		if e.Name == name {
+			return &epics[i]
+		}
 	}
 
-	i := promptUserSelectResource()
-	if i >= len(yesNoOpts) {
-		log.Fatal(errOutOfRange)
+	return nil
+}
+
+func (co *ClubhouseOptions) promptUserIfAddCommentWithTrelloLink() error {
+	yes, err := promptUserYesNo("Would you like a comment added with the original trello ticket link?")
+	if err != nil {
+		return err
 	}
 
-	if i == 0 {
+	if yes {
 		co.AddCommentWithTrelloLink = true
 	}
+
+	return nil
 }
 
-func (co *ClubhouseOptions) getProjectsAndPromptUser() {
+func (co *ClubhouseOptions) getProjectsAndPromptUser() error {
 	projects, err := co.ClubhouseEntry.ListProjects()
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("querying the clubhouse projects: %s", err)
 	}
 
-	fmt.Println("Please select a project by it number to import the cards into")
-	for i, p := range projects {
-		fmt.Printf("[%d] %s\n", i, p.Name)
+	if co.sel.Project != "" {
+		for i, p := range projects {
+			if strconv.FormatInt(p.ID, 10) == co.sel.Project || strings.EqualFold(p.Name, co.sel.Project) {
+				co.Project = &projects[i]
+				return nil
+			}
+		}
+
+		return fmt.Errorf("project '%s' not found", co.sel.Project)
 	}
 
-	i := promptUserSelectResource()
-	if i >= len(projects) {
-		log.Fatal(errOutOfRange)
+	var names []string
+	for _, p := range projects {
+		names = append(names, p.Name)
+	}
+
+	i, err := ui.Select("Please select a project by it number to import the cards into, or type part of its name to search", names)
+	if err != nil {
+		return err
 	}
 
 	co.Project = &projects[i]
+
+	return nil
 }
 
-func (co *ClubhouseOptions) getMembersAndPromptUser() {
+func (co *ClubhouseOptions) getMembersAndPromptUser() error {
 	members, err := co.ClubhouseEntry.ListMembers()
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("retrieving clubhouse members: %s", err)
 	}
 
-	fmt.Println("Please select a backup user account if a user is not mapped correctly")
-	for i, u := range members {
-		fmt.Printf("[%d] %s\n", i, u.Profile.Name)
+	var names []string
+	for _, u := range members {
+		names = append(names, u.Profile.Name)
 	}
 
-	i := promptUserSelectResource()
-	if i >= len(members) {
-		log.Fatal(errOutOfRange)
+	i, err := ui.Select("Please select a backup user account if a user is not mapped correctly, or type part of a name to search", names)
+	if err != nil {
+		return err
 	}
 
 	co.ImportMember = &members[i]
+
+	return nil
 }
 
-func (co *ClubhouseOptions) getWorkflowStatesAndPromptUser() {
+func (co *ClubhouseOptions) getWorkflowStatesAndPromptUser() (err error) {
+	if co.sel.State != "" {
+		co.State, err = co.findWorkflowState(co.sel.State)
+		return err
+	}
+
+	co.State, err = co.promptUserForWorkflowState(fmt.Sprintf("Please select a workflow state linked to '%s' - to import the trello cards into", co.Project.Name))
+	return err
+}
+
+// promptUserForListStates asks for the workflow state of the cards in each
+// list, the cards of a list without one go into the selected workflow state
+func (co *ClubhouseOptions) promptUserForListStates(lists []trello.List) error {
+	if len(lists) < 2 || co.sel.State != "" {
+		return nil
+	}
+
+	yes, err := promptUserYesNo("Would you like to select a workflow state for the cards of each trello list?")
+	if err != nil || !yes {
+		return err
+	}
+
+	for _, l := range lists {
+		s, err := co.promptUserForWorkflowState(fmt.Sprintf("Please select the workflow state for the cards in the trello list '%s'", l.Name))
+		if err != nil {
+			return err
+		}
+
+		co.ListStates[l.Id] = ListState{ListName: l.Name, State: s}
+	}
+
+	return nil
+}
+
+// findWorkflowState finds the state by its id or name in
+// the workflows of the team the selected project belongs to
+func (co *ClubhouseOptions) findWorkflowState(state string) (*ch.State, error) {
 	workflows, err := co.ClubhouseEntry.ListWorkflow()
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("querying the clubhouse workflows: %s", err)
+	}
+
+	for _, w := range workflows {
+		if w.TeamID != co.Project.TeamID {
+			continue
+		}
+
+		for i, s := range w.States {
+			if strconv.FormatInt(s.ID, 10) == state || strings.EqualFold(s.Name, state) {
+				return &w.States[i], nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("workflow state '%s' not found for the project '%s'", state, co.Project.Name)
+}
+
+func (co *ClubhouseOptions) promptUserForWorkflowState(question string) (*ch.State, error) {
+	workflows, err := co.ClubhouseEntry.ListWorkflow()
+	if err != nil {
+		return nil, fmt.Errorf("querying the clubhouse workflows: %s", err)
 	}
 
-	fmt.Printf("Please select a workflow state linked to '%s' - to import the trello cards into\n", co.Project.Name)
 	var options []worfklowState
 
 	for wIdx, w := range workflows {
@@ -128,31 +331,155 @@ func (co *ClubhouseOptions) getWorkflowStatesAndPromptUser() {
 		}
 	}
 
-	for i, o := range options {
-		fmt.Printf("[%d] %s\n", i, o.DisplayText)
+	var names []string
+	for _, o := range options {
+		names = append(names, o.DisplayText)
 	}
 
-	i := promptUserSelectResource()
-	if i >= len(options) {
-		log.Fatal(errOutOfRange)
+	i, err := ui.Select(question, names)
+	if err != nil {
+		return nil, err
 	}
 
 	selected := options[i]
-	co.State = &workflows[selected.WorkflowIdx].States[selected.StateIdx]
+	return &workflows[selected.WorkflowIdx].States[selected.StateIdx], nil
 }
 
-func (co *ClubhouseOptions) promptUserForStoryType() {
-	types := []string{"feature", "chore", "bug"}
+func (co *ClubhouseOptions) promptUserForDueCompleteCards(cards *[]Card) error {
+	var dueComplete bool
+	for _, c := range *cards {
+		dueComplete = dueComplete || c.DueComplete
+	}
 
-	fmt.Println("Please select the story type all cards should be imported as")
-	for i, t := range types {
-		fmt.Printf("[%d] %s\n", i, t)
+	if !dueComplete {
+		return nil
+	}
+
+	opts := []string{
+		"Keep the deadline",
+		"Drop the deadline",
+		"Into a done workflow state",
+	}
+
+	i, err := ui.Select("How should the cards with a due date marked complete in trello be imported?", opts)
+	if err != nil {
+		return err
 	}
 
-	i := promptUserSelectResource()
-	if i >= len(types) {
-		log.Fatal(errOutOfRange)
+	switch i {
+	case 1:
+		co.DropCompletedDeadline = true
+	case 2:
+		co.DueCompleteState, err = co.promptUserForWorkflowState("Please select the done workflow state for the cards with a completed due date")
+	}
+
+	return err
+}
+
+func (co *ClubhouseOptions) promptUserForArchivedCards(cards *[]Card) error {
+	var archived bool
+	for _, c := range *cards {
+		archived = archived || c.Archived
+	}
+
+	if !archived {
+		return nil
+	}
+
+	opts := []string{
+		"As archived stories",
+		fmt.Sprintf("Into a done workflow state with an '%s' label", archivedLabel),
+	}
+
+	i, err := ui.Select("How should the cards archived in trello be imported?", opts)
+	if err != nil {
+		return err
+	}
+
+	if i == 1 {
+		co.ArchivedState, err = co.promptUserForWorkflowState("Please select the done workflow state for the archived cards")
+	}
+
+	return err
+}
+
+func (co *ClubhouseOptions) promptUserForStoryType() error {
+	types := []string{"feature", "chore", "bug"}
+
+	i, err := ui.Select("Please select the story type all cards should be imported as", types)
+	if err != nil {
+		return err
 	}
 
 	co.StoryType = types[i]
+
+	return nil
+}
+
+func (co *ClubhouseOptions) getEpicsAndPromptUserForLabelMapping(cards *[]Card) error {
+	labels := co.uniqueLabelNamesFromCards(cards)
+	if len(labels) == 0 {
+		return nil
+	}
+
+	yes, err := promptUserYesNo("Would you like to map trello labels to clubhouse epics?")
+	if err != nil || !yes {
+		return err
+	}
+
+	epics, err := co.ClubhouseEntry.ListEpics()
+	if err != nil {
+		return fmt.Errorf("querying the clubhouse epics: %s", err)
+	}
+
+	labelOpts := append([]string{"Finished mapping labels"}, labels...)
+
+	for {
+		selected, err := ui.SelectMany("Please select the trello labels to map to an epic, or type part of a name to search", labelOpts)
+		if err != nil {
+			return err
+		}
+
+		if selected[0] == 0 {
+			break
+		}
+
+		var names []string
+		for _, i := range selected {
+			names = append(names, labels[i-1])
+		}
+
+		epicOpts := []string{fmt.Sprintf("Create a new epic for each label '%s'", strings.Join(names, "', '"))}
+		for _, e := range epics {
+			epicOpts = append(epicOpts, e.Name)
+		}
+
+		question := fmt.Sprintf("Please select the epic for the labels '%s', or type part of its name to search", strings.Join(names, "', '"))
+		i, err := ui.Select(question, epicOpts)
+		if err != nil {
+			return err
+		}
+
+		for _, label := range names {
+			co.LabelEpics[label] = 0
+			if i > 0 {
+				co.LabelEpics[label] = epics[i-1].ID
+			}
+		}
+	}
+
+	if len(co.LabelEpics) == 0 {
+		return nil
+	}
+
+	yes, err = promptUserYesNo("Would you like the mapped labels removed from the stories?")
+	if err != nil {
+		return err
+	}
+
+	if yes {
+		co.RemoveEpicLabels = true
+	}
+
+	return nil
 }
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	ch "github.com/jnormington/clubhouse-go"
+)
+
+const usage = `Usage: trello_to_clubhouse [command] [flags]
+
+Commands:
+  migrate    ask all the questions then export and import each card, full
+             screen unless -line is given (default)
+  export     export the cards from trello to a file
+  import     plan and apply the migration of an exported file
+  map-users  generate the user mapping csv
+  plan       ask all the questions and write a plan for review
+  apply      apply a plan written by plan
+  verify     compare the stories created by a run with their trello cards
+  rollback   delete everything created by a run
+
+Run a command with -h to see its flags.
+`
+
+// Selection holds the board, list, project and state given as flags
+// so they don't need to be selected by answering the questions
+type Selection struct {
+	Board    string
+	List     string
+	AllLists bool
+	Project  string
+	State    string
+}
+
+func addTrelloFlags(fs *flag.FlagSet, sel *Selection) {
+	fs.StringVar(&sel.Board, "board", "", "trello board name or id")
+	fs.StringVar(&sel.List, "list", "", "trello list name or id")
+	fs.BoolVar(&sel.AllLists, "all-lists", false, "migrate all lists on the board, each list becomes an epic")
+}
+
+func addClubhouseFlags(fs *flag.FlagSet, sel *Selection) {
+	fs.StringVar(&sel.Project, "project", "", "clubhouse project name or id")
+	fs.StringVar(&sel.State, "state", "", "clubhouse workflow state name or id")
+}
+
+func newFlagSet(name, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, strings.TrimSpace("Usage: trello_to_clubhouse "+name+" [flags] "+args))
+		fs.PrintDefaults()
+	}
+
+	return fs
+}
+
+// runCommand runs the command, exiting with exitSetupError when it couldn't run,
+// exitInterrupted when it was stopped by a signal and exitCardErrors when some
+// of the cards had errors
+func runCommand(args []string) {
+	err := dispatchCommand(args)
+
+	failures.WriteSummary(os.Stderr)
+
+	if err == errInterrupted {
+		os.Exit(exitInterrupted)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(exitSetupError)
+	}
+
+	if len(failures.Errors) > 0 {
+		os.Exit(exitCardErrors)
+	}
+}
+
+func dispatchCommand(args []string) error {
+	cmd := "migrate"
+	if len(args) > 0 {
+		cmd, args = args[0], args[1:]
+	}
+
+	switch cmd {
+	case "migrate":
+		return runMigrate(args)
+	case "export":
+		return runExport(args)
+	case "import":
+		return runImport(args)
+	case "map-users":
+		return runMapUsers(args)
+	case "plan":
+		return runPlan(args)
+	case "apply":
+		return RunApply(args)
+	case "verify":
+		return RunVerify(args)
+	case "rollback":
+		return RunRollback(args)
+	case "help", "-h", "-help", "--help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command '%s'\n\n%s", cmd, usage)
+		os.Exit(exitUsage)
+	}
+
+	return nil
+}
+
+func runMigrate(args []string) error {
+	var sel Selection
+
+	fs := newFlagSet("migrate", "")
+	addTrelloFlags(fs, &sel)
+	addClubhouseFlags(fs, &sel)
+	resume := fs.String("resume", "", "resume the interrupted run id, skipping the cards it imported")
+	line := fs.Bool("line", false, "ask the questions line by line instead of in the full screen interface")
+	fs.Parse(args)
+
+	if *line || !stdinIsTerminal() {
+		return Migrate(&sel, *resume)
+	}
+
+	return runWithTUI(func() error {
+		return Migrate(&sel, *resume)
+	})
+}
+
+func runExport(args []string) error {
+	var sel Selection
+
+	fs := newFlagSet("export", "")
+	addTrelloFlags(fs, &sel)
+	fs.Parse(args)
+
+	e, err := ExportFromTrello(&sel)
+	if err != nil {
+		return err
+	}
+
+	path, err := e.Save()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Exported %d cards to: %s\n", len(e.Cards), path)
+	fmt.Printf("To import the cards use: import %s\n", e.ExportID)
+
+	return nil
+}
+
+func runImport(args []string) error {
+	var sel Selection
+
+	fs := newFlagSet("import", "<export-id>")
+	addClubhouseFlags(fs, &sel)
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+
+	e, err := LoadExport(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	return planAndApply(e, &sel)
+}
+
+// planAndApply plans the exported cards and applies the plan once confirmed
+func planAndApply(e *Export, sel *Selection) error {
+	p, err := CreatePlan(e, sel)
+	if err != nil {
+		return err
+	}
+
+	if err := confirmPlanBeforeApply(p); err != nil {
+		return err
+	}
+
+	return ApplyPlan(p, nil)
+}
+
+func runPlan(args []string) error {
+	var sel Selection
+	var exportID string
+
+	fs := newFlagSet("plan", "")
+	addTrelloFlags(fs, &sel)
+	addClubhouseFlags(fs, &sel)
+	fs.StringVar(&exportID, "export", "", "plan the cards of an export id instead of exporting from trello")
+	fs.Parse(args)
+
+	var e *Export
+	var err error
+	if exportID != "" {
+		e, err = LoadExport(exportID)
+	} else {
+		e, err = ExportFromTrello(&sel)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	p, err := CreatePlan(e, &sel)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("To apply this plan use: apply %s\n", p.PlanID)
+
+	return nil
+}
+
+// runMapUsers generates the best guess user mapping csv for
+// the board members so it can be edited before migrating
+func runMapUsers(args []string) error {
+	var sel Selection
+
+	fs := newFlagSet("map-users", "")
+	fs.StringVar(&sel.Board, "board", "", "trello board name or id")
+	fs.Parse(args)
+
+	to := TrelloOptions{sel: &sel}
+	if err := to.getCurrentUser(); err != nil {
+		return err
+	}
+
+	if err := to.getBoardsAndPromptUser(); err != nil {
+		return err
+	}
+
+	trelloMembers, err := to.ListMembers()
+	if err != nil {
+		return err
+	}
+
+	co := ClubhouseOptions{ClubhouseEntry: ch.New(clubHouseToken)}
+
+	clubhouseMembers, err := co.ListMembers()
+	if err != nil {
+		return err
+	}
+
+	um := UserMap{
+		TrelloMembers:    trelloMembers,
+		ClubhouseMembers: clubhouseMembers,
+		Mapping:          make(map[string]string),
+	}
+
+	return um.GenerateUserMapCSV()
+}
+
+// RunApply applies a plan file previously written by plan,
+// or with -resume continues the interrupted run of a plan
+func RunApply(args []string) error {
+	fs := newFlagSet("apply", "<plan-id>")
+	resume := fs.String("resume", "", "resume the interrupted run id instead of starting a new run")
+	fs.Parse(args)
+
+	var rl *RunLog
+	planID := fs.Arg(0)
+
+	if *resume != "" {
+		var err error
+		if rl, err = LoadRunLog(*resume); err != nil {
+			return err
+		}
+
+		if rl.PlanID != "" {
+			planID = rl.PlanID
+		}
+	}
+
+	if planID == "" || fs.NArg() > 1 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+
+	p, err := LoadPlan(planID)
+	if err != nil {
+		return err
+	}
+
+	return ApplyPlan(p, rl)
+}
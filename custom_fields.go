@@ -0,0 +1,291 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	trello "github.com/jnormington/go-trello"
+)
+
+// Where a trello custom field is migrated to in clubhouse
+const (
+	customFieldToDescription = "description"
+	customFieldToLabel       = "label"
+	customFieldToEstimate    = "estimate"
+	customFieldToClubhouse   = "clubhouse"
+)
+
+// CustomField is a trello custom field value of a card
+type CustomField struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// trelloCustomFieldDef is a custom field definition on the trello board
+type trelloCustomFieldDef struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Options []struct {
+		ID    string `json:"id"`
+		Value struct {
+			Text string `json:"text"`
+		} `json:"value"`
+	} `json:"options"`
+}
+
+// trelloCustomFieldItem is the value of a custom field on a trello card
+type trelloCustomFieldItem struct {
+	IDCustomField string `json:"idCustomField"`
+	IDValue       string `json:"idValue"`
+	Value         struct {
+		Text    string `json:"text"`
+		Number  string `json:"number"`
+		Date    string `json:"date"`
+		Checked string `json:"checked"`
+	} `json:"value"`
+}
+
+// clubhouseCustomField is a custom field defined in clubhouse
+type clubhouseCustomField struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+	Values  []struct {
+		ID    string `json:"id"`
+		Value string `json:"value"`
+	} `json:"values"`
+}
+
+// CustomFieldTarget is where the user chose to migrate a trello custom field
+type CustomFieldTarget struct {
+	Kind    string
+	FieldID string
+}
+
+func getCustomFieldDefsForBoard(boardID string) ([]trelloCustomFieldDef, error) {
+	var defs []trelloCustomFieldDef
+
+	err := getTrelloResource("/boards/"+boardID+"/customFields", nil, &defs)
+	if err != nil {
+		return nil, fmt.Errorf("querying the board custom fields: %s", err)
+	}
+
+	return defs, nil
+}
+
+func getCustomFieldsForCard(card *trello.Card, defs []trelloCustomFieldDef) []CustomField {
+	var items []trelloCustomFieldItem
+	var fields []CustomField
+
+	err := getTrelloResource("/cards/"+card.Id+"/customFieldItems", nil, &items)
+	if err != nil {
+		recordCardError(stageExport, card.Name, card.ShortUrl, fmt.Errorf("querying the custom fields: %s", err))
+	}
+
+	for _, i := range items {
+		for _, d := range defs {
+			if d.ID != i.IDCustomField {
+				continue
+			}
+
+			if v := customFieldItemValue(&d, &i); v != "" {
+				fields = append(fields, CustomField{Name: d.Name, Value: v})
+			}
+		}
+	}
+
+	return fields
+}
+
+func customFieldItemValue(def *trelloCustomFieldDef, item *trelloCustomFieldItem) string {
+	switch def.Type {
+	case "list":
+		for _, o := range def.Options {
+			if o.ID == item.IDValue {
+				return o.Value.Text
+			}
+		}
+	case "number":
+		return item.Value.Number
+	case "date":
+		if d := parseDateOrReturnNil(item.Value.Date); d != nil {
+			return d.Format("2006-01-02")
+		}
+	case "checkbox":
+		if item.Value.Checked == "true" {
+			return "Yes"
+		}
+	default:
+		return item.Value.Text
+	}
+
+	return ""
+}
+
+func (co *ClubhouseOptions) getCustomFieldsAndPromptUser(cards *[]Card) error {
+	var names []string
+	seen := map[string]bool{}
+
+	for _, c := range *cards {
+		for _, f := range c.CustomFields {
+			if !seen[f.Name] {
+				seen[f.Name] = true
+				names = append(names, f.Name)
+			}
+		}
+	}
+
+	if len(names) == 0 {
+		return nil
+	}
+
+	var chFields []clubhouseCustomField
+	err := doClubhouseRequest("GET", "/custom-fields", nil, &chFields)
+	if err != nil {
+		return fmt.Errorf("querying the clubhouse custom fields: %s", err)
+	}
+
+	for _, n := range names {
+		opts := []CustomFieldTarget{
+			{Kind: customFieldToDescription},
+			{Kind: customFieldToLabel},
+			{Kind: customFieldToEstimate},
+		}
+
+		names := []string{
+			"A custom fields table in the description",
+			"A label 'name: value'",
+			"The story estimate",
+		}
+
+		for _, f := range chFields {
+			if !f.Enabled {
+				continue
+			}
+
+			names = append(names, fmt.Sprintf("Clubhouse custom field '%s'", f.Name))
+			opts = append(opts, CustomFieldTarget{Kind: customFieldToClubhouse, FieldID: f.ID})
+		}
+
+		question := fmt.Sprintf("Please select where the trello custom field '%s' should be migrated to", n)
+		i, err := ui.Select(question, names)
+		if err != nil {
+			return err
+		}
+
+		co.CustomFieldTargets[n] = opts[i]
+	}
+
+	co.ClubhouseCustomFields = chFields
+
+	return nil
+}
+
+// buildCustomFieldsTable returns a markdown table of the custom
+// fields the user chose to migrate into the description
+func buildCustomFieldsTable(card *Card, opts *ClubhouseOptions) string {
+	var rows []string
+
+	for _, f := range card.CustomFields {
+		if opts.CustomFieldTargets[f.Name].Kind == customFieldToDescription {
+			rows = append(rows, fmt.Sprintf("| %s | %s |", f.Name, f.Value))
+		}
+	}
+
+	if len(rows) == 0 {
+		return ""
+	}
+
+	return "Custom fields\n\n| Field | Value |\n| --- | --- |\n" + strings.Join(rows, "\n")
+}
+
+// buildEstimate returns the estimate parsed from the card name
+// or the first custom field the user chose as the estimate
+func buildEstimate(card *Card, opts *ClubhouseOptions) *int64 {
+	if card.Estimate != nil {
+		return card.Estimate
+	}
+
+	for _, f := range card.CustomFields {
+		if opts.CustomFieldTargets[f.Name].Kind != customFieldToEstimate {
+			continue
+		}
+
+		if n, err := strconv.ParseFloat(f.Value, 64); err == nil {
+			e := int64(math.Round(n))
+			return &e
+		}
+	}
+
+	return nil
+}
+
+func customFieldLabels(card *Card, opts *ClubhouseOptions) []string {
+	var labels []string
+
+	for _, f := range card.CustomFields {
+		if opts.CustomFieldTargets[f.Name].Kind == customFieldToLabel {
+			labels = append(labels, fmt.Sprintf("%s: %s", f.Name, f.Value))
+		}
+	}
+
+	return labels
+}
+
+// StoryCustomField is the value of a clubhouse custom field to set on a story
+type StoryCustomField struct {
+	FieldID string `json:"field_id"`
+	ValueID string `json:"value_id"`
+}
+
+// buildStoryCustomFields returns the clubhouse custom field values for the card,
+// the value must match one of the values defined for the clubhouse field
+func buildStoryCustomFields(card *Card, opts *ClubhouseOptions) []StoryCustomField {
+	var values []StoryCustomField
+
+	for _, f := range card.CustomFields {
+		t := opts.CustomFieldTargets[f.Name]
+		if t.Kind != customFieldToClubhouse {
+			continue
+		}
+
+		valueID := opts.clubhouseCustomFieldValueID(t.FieldID, f.Value)
+		if valueID == "" {
+			fmt.Printf("No clubhouse value '%s' for custom field '%s' on card %s ignoring...\n", f.Value, f.Name, card.ShortURL)
+			continue
+		}
+
+		values = append(values, StoryCustomField{FieldID: t.FieldID, ValueID: valueID})
+	}
+
+	return values
+}
+
+// setStoryCustomFields sets the clubhouse custom field values on the created story
+func setStoryCustomFields(storyID int64, values []StoryCustomField) error {
+	if len(values) == 0 {
+		return nil
+	}
+
+	body := map[string]interface{}{"custom_fields": values}
+	return doClubhouseRequest("PUT", fmt.Sprintf("/stories/%d", storyID), body, nil)
+}
+
+func (co *ClubhouseOptions) clubhouseCustomFieldValueID(fieldID, value string) string {
+	for _, f := range co.ClubhouseCustomFields {
+		if f.ID != fieldID {
+			continue
+		}
+
+		for _, v := range f.Values {
+			if strings.EqualFold(v.Value, value) {
+				return v.ID
+			}
+		}
+	}
+
+	return ""
+}
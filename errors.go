@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Exit codes so a script running the migration can tell how it went
+const (
+	exitSetupError  = 1 // the command couldn't start or stopped early
+	exitUsage       = 2 // the command or its flags were wrong
+	exitCardErrors  = 3 // the command finished but some cards had errors
+	exitInterrupted = 4 // the command was stopped by a signal after the current card
+)
+
+// The stages of a card an error can occur in
+const (
+	stageExport        = "export"
+	stageAttachments   = "attachments"
+	stageChecklistEpic = "checklist epic"
+	stageCreateStory   = "create story"
+	stageLinkedFiles   = "linked files"
+	stageCustomFields  = "custom fields"
+	stageChecklists    = "checklist stories"
+	stageOrdering      = "ordering"
+	stageVerify        = "verify"
+	stageRollback      = "rollback"
+	stageRunLog        = "run log"
+)
+
+// CardError is an error for a single card, it doesn't stop
+// the migration of the other cards
+type CardError struct {
+	Stage string
+	Card  string
+	URL   string
+	Err   error
+}
+
+func (e CardError) Error() string {
+	if e.URL == "" {
+		return fmt.Sprintf("%s: %s", e.Card, e.Err)
+	}
+
+	return fmt.Sprintf("%s %s: %s", e.URL, e.Card, e.Err)
+}
+
+// FailureSummary collects the card errors of a command
+// so they can be listed together once it finishes
+type FailureSummary struct {
+	Errors []CardError
+
+	// Cards are exported and imported at the same time
+	mu sync.Mutex
+}
+
+var failures FailureSummary
+
+// Add records an error for the card at the given stage
+func (f *FailureSummary) Add(stage, card, url string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.Errors = append(f.Errors, CardError{Stage: stage, Card: card, URL: url, Err: err})
+}
+
+// ForURL returns the errors recorded so far for the card with the url
+func (f *FailureSummary) ForURL(url string) []CardError {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var errs []CardError
+	for _, e := range f.Errors {
+		if e.URL == url {
+			errs = append(errs, e)
+		}
+	}
+
+	return errs
+}
+
+// recordCardError prints the error for the card and records it in the failures
+func recordCardError(stage, card, url string, err error) {
+	fmt.Printf("Error: %s of %s continuing... %s\n", stage, card, err)
+	failures.Add(stage, card, url, err)
+}
+
+// WriteSummary writes the card errors grouped by the stage they occurred in
+func (f *FailureSummary) WriteSummary(w io.Writer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(f.Errors) == 0 {
+		return
+	}
+
+	var stages []string
+	byStage := map[string][]CardError{}
+
+	for _, e := range f.Errors {
+		if _, ok := byStage[e.Stage]; !ok {
+			stages = append(stages, e.Stage)
+		}
+
+		byStage[e.Stage] = append(byStage[e.Stage], e)
+	}
+
+	fmt.Fprintf(w, "\n%d card errors occurred:\n", len(f.Errors))
+
+	for _, s := range stages {
+		fmt.Fprintf(w, "%s (%d):\n", s, len(byStage[s]))
+
+		for _, e := range byStage[s] {
+			fmt.Fprintf(w, "\t%s\n", e)
+		}
+	}
+}
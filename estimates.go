@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const estimatePatternsFile = "estimatePatterns.csv"
+
+// defaultEstimatePatterns match the Scrum for Trello and Plus for Trello points
+// syntax, the estimate as a leading (3) and the consumed points as a leading or trailing [2]
+var defaultEstimatePatterns = []EstimatePattern{
+	{Regexp: regexp.MustCompile(`^\s*\(\s*(\d+(?:\.\d+)?)\s*\)`), SetEstimate: true},
+	{Regexp: regexp.MustCompile(`^\s*\[\s*\d+(?:\.\d+)?\s*\]|\[\s*\d+(?:\.\d+)?\s*\]\s*$`)},
+}
+
+// EstimatePattern is a regex matching points in the card name, the first
+// capture group is the points when the pattern sets the estimate
+type EstimatePattern struct {
+	Regexp      *regexp.Regexp
+	SetEstimate bool
+}
+
+// estimatePatternJSON is how a pattern is saved with an export or run
+type estimatePatternJSON struct {
+	Pattern     string `json:"pattern"`
+	SetEstimate bool   `json:"set_estimate"`
+}
+
+// MarshalJSON encodes the pattern as its regex source
+func (p EstimatePattern) MarshalJSON() ([]byte, error) {
+	return json.Marshal(estimatePatternJSON{Pattern: p.Regexp.String(), SetEstimate: p.SetEstimate})
+}
+
+// UnmarshalJSON decodes a pattern saved with an export or run, compiling its regex
+func (p *EstimatePattern) UnmarshalJSON(b []byte) error {
+	var v estimatePatternJSON
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+
+	re, err := regexp.Compile(v.Pattern)
+	if err != nil {
+		return err
+	}
+
+	p.Regexp, p.SetEstimate = re, v.SetEstimate
+	return nil
+}
+
+// LoadEstimatePatterns reads the estimate patterns csv with the columns
+// Pattern and SetEstimate or returns the default patterns if there is no csv
+func LoadEstimatePatterns(path string) ([]EstimatePattern, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return defaultEstimatePatterns, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("opening estimate patterns file: %s", err)
+	}
+
+	defer f.Close()
+
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("reading estimate patterns file: %s", err)
+	}
+
+	var patterns []EstimatePattern
+	for i, row := range rows {
+		if i == 0 {
+			// Its the header row
+			continue
+		}
+
+		if len(row) != 2 || row[0] == "" {
+			continue
+		}
+
+		re, err := regexp.Compile(row[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex on estimate patterns line %d: %s", i+1, err)
+		}
+
+		patterns = append(patterns, EstimatePattern{Regexp: re, SetEstimate: row[1] == "yes"})
+	}
+
+	return patterns, nil
+}
+
+// parseEstimateFromName strips the first match of every pattern from the card name and
+// returns the estimate from the first matching pattern which sets the estimate
+func parseEstimateFromName(name string, patterns []EstimatePattern) (string, *int64) {
+	var estimate *int64
+
+	for _, p := range patterns {
+		m := p.Regexp.FindStringSubmatchIndex(name)
+		if m == nil {
+			continue
+		}
+
+		if p.SetEstimate && estimate == nil && len(m) > 3 && m[2] >= 0 {
+			if f, err := strconv.ParseFloat(name[m[2]:m[3]], 64); err == nil {
+				e := int64(math.Round(f))
+				estimate = &e
+			}
+		}
+
+		name = name[:m[0]] + name[m[1]:]
+	}
+
+	return strings.Join(strings.Fields(name), " "), estimate
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestParseEstimateFromName(t *testing.T) {
+	custom := []EstimatePattern{{Regexp: regexp.MustCompile(`\s*\{(\d+)pts\}`), SetEstimate: true}}
+
+	tests := []struct {
+		name     string
+		patterns []EstimatePattern
+		wantName string
+		want     int64
+		wantNil  bool
+	}{
+		{name: "(3) Add the login page", wantName: "Add the login page", want: 3},
+		{name: " ( 2.5 ) Add the login page", wantName: "Add the login page", want: 3},
+		{name: "(3) Add the login page [2]", wantName: "Add the login page", want: 3},
+		{name: "[2] (3) Add the login page", wantName: "(3) Add the login page", wantNil: true},
+		{name: "Add the login page [1.5]", wantName: "Add the login page", wantNil: true},
+		{name: "Add the login page (3)", wantName: "Add the login page (3)", wantNil: true},
+		{name: "Add the login page", wantName: "Add the login page", wantNil: true},
+		{name: "Add the {5pts} login page", patterns: custom, wantName: "Add the login page", want: 5},
+		{name: "(3) Add the login page", patterns: custom, wantName: "(3) Add the login page", wantNil: true},
+	}
+
+	for _, tt := range tests {
+		patterns := tt.patterns
+		if patterns == nil {
+			patterns = defaultEstimatePatterns
+		}
+
+		name, estimate := parseEstimateFromName(tt.name, patterns)
+		if name != tt.wantName {
+			t.Errorf("parseEstimateFromName(%q) name = %q, want %q", tt.name, name, tt.wantName)
+		}
+
+		switch {
+		case tt.wantNil && estimate != nil:
+			t.Errorf("parseEstimateFromName(%q) estimate = %d, want none", tt.name, *estimate)
+		case !tt.wantNil && estimate == nil:
+			t.Errorf("parseEstimateFromName(%q) estimate = none, want %d", tt.name, tt.want)
+		case !tt.wantNil && *estimate != tt.want:
+			t.Errorf("parseEstimateFromName(%q) estimate = %d, want %d", tt.name, *estimate, tt.want)
+		}
+	}
+}
@@ -1,11 +1,16 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
+	"net/url"
 	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	trello "github.com/jnormington/go-trello"
@@ -13,28 +18,68 @@ import (
 )
 
 var dateLayout = "2006-01-02T15:04:05.000Z"
+var timelineDateLayout = "2006-01-02 15:04 MST"
 var safeFileNameRegexp = regexp.MustCompile(`[^a-zA-Z0-9_.]+`)
 
 // Card holds all the attributes needed for migrating a complete card from Trello to Clubhouse
 type Card struct {
-	Name        string            `json:"name"`
-	Desc        string            `json:"desc"`
-	Labels      []string          `json:"labels"`
-	DueDate     *time.Time        `json:"due_date"`
-	IDCreator   string            `json:"id_creator"`
-	IDOwners    []string          `json:"id_owners"`
-	CreatedAt   *time.Time        `json:"created_at"`
-	Comments    []Comment         `json:"comments"`
-	Tasks       []Task            `json:"checklists"`
-	Position    float32           `json:"position"`
-	ShortURL    string            `json:"url"`
-	Attachments map[string]string `json:"attachments"`
+	ID               string            `json:"id"`
+	LastActivity     string            `json:"last_activity"`
+	Name             string            `json:"name"`
+	Estimate         *int64            `json:"estimate"`
+	Desc             string            `json:"desc"`
+	Labels           []Label           `json:"labels"`
+	DueDate          *time.Time        `json:"due_date"`
+	DueComplete      bool              `json:"due_complete"`
+	StartDate        *time.Time        `json:"start_date"`
+	IDCreator        string            `json:"id_creator"`
+	IDOwners         []string          `json:"id_owners"`
+	IDFollowers      []string          `json:"id_followers"`
+	CreatedAt        *time.Time        `json:"created_at"`
+	Comments         []Comment         `json:"comments"`
+	Tasks            []Task            `json:"checklists"`
+	Position         float32           `json:"position"`
+	ListPosition     float32           `json:"list_position"`
+	ShortURL         string            `json:"url"`
+	IDList           string            `json:"id_list"`
+	Archived         bool              `json:"archived"`
+	Attachments      map[string]string `json:"attachments"`
+	AttachmentsFound int               `json:"attachments_found"`
+	Timeline         []TimelineEvent   `json:"timeline"`
+	CustomFields     []CustomField     `json:"custom_fields"`
+}
+
+// Label builds a basic object based off the trello card labels
+type Label struct {
+	Name  string `json:"name"`
+	Color string `json:"color"`
 }
 
 // Task builds a basic object based off trello.Task
 type Task struct {
-	Completed   bool   `json:"completed"`
-	Description string `json:"description"`
+	Completed   bool       `json:"completed"`
+	Description string     `json:"description"`
+	ChecklistID string     `json:"checklist_id"`
+	Checklist   string     `json:"checklist"`
+	Name        string     `json:"name"`
+	IDOwner     string     `json:"id_owner"`
+	DueDate     *time.Time `json:"due_date"`
+	Position    float32    `json:"position"`
+}
+
+// checklist holds the parts of a trello checklist we need, including
+// the check item member and due date which the trello package doesn't decode
+type checklist struct {
+	ID         string  `json:"id"`
+	Name       string  `json:"name"`
+	Pos        float32 `json:"pos"`
+	CheckItems []struct {
+		Name     string  `json:"name"`
+		State    string  `json:"state"`
+		Pos      float32 `json:"pos"`
+		IDMember string  `json:"idMember"`
+		Due      string  `json:"due"`
+	} `json:"checkItems"`
 }
 
 // Comment builds a basic object based off trello.Comment
@@ -45,33 +90,144 @@ type Comment struct {
 	CreatedAt   *time.Time
 }
 
+// TimelineEvent is a single list move, member change or due date
+// change taken from the trello card actions
+type TimelineEvent struct {
+	Text        string
+	IDCreator   string
+	CreatorName string
+	IDMember    string
+	MemberName  string
+	CreatedAt   *time.Time
+}
+
+// timelineAction holds the parts of a trello action we need for the timeline
+// which the trello package doesn't decode
+type timelineAction struct {
+	Type string `json:"type"`
+	Date string `json:"date"`
+	Data struct {
+		ListBefore struct {
+			Name string `json:"name"`
+		} `json:"listBefore"`
+		ListAfter struct {
+			Name string `json:"name"`
+		} `json:"listAfter"`
+		Card struct {
+			Due *string `json:"due"`
+		} `json:"card"`
+		Old map[string]json.RawMessage `json:"old"`
+	} `json:"data"`
+	MemberCreator struct {
+		ID       string `json:"id"`
+		FullName string `json:"fullName"`
+	} `json:"memberCreator"`
+	Member struct {
+		ID       string `json:"id"`
+		FullName string `json:"fullName"`
+	} `json:"member"`
+}
+
 // ProcessCardsForExporting takes *[]trello.Card, *TrelloOptions and builds up a Card
 // which consists of calling other functions to make the api calls to Trello
-// for the relevant attributes of a card returns *[]Card
-func ProcessCardsForExporting(crds *[]trello.Card, opts *TrelloOptions) *[]Card {
+// for the relevant attributes of a card returns *[]Card. Once ctx is cancelled
+// it stops before the next card and returns the cards done with errInterrupted
+func ProcessCardsForExporting(ctx context.Context, crds *[]trello.Card, opts *TrelloOptions) (*[]Card, error) {
 	var cards []Card
 
-	for _, card := range *crds {
-		var c Card
-
-		c.Name = card.Name
-		c.Desc = card.Desc
-		c.Labels = getLabelsFlattenFromCard(&card)
-		c.DueDate = parseDateOrReturnNil(card.Due)
-		c.IDCreator, c.CreatedAt, c.Comments = getCommentsAndCardCreator(&card)
-		c.Tasks = getCheckListsForCard(&card)
-		c.Position = card.Pos
-		c.ShortURL = card.ShortUrl
-		c.IDOwners = card.IdMembers
-
-		if opts.ProcessImages {
-			c.Attachments = downloadCardAttachmentsUploadToDropbox(&card)
-		}
+	out := make(chan Card)
+	errc := make(chan error, 1)
 
+	go func() {
+		errc <- StreamCardsForExporting(ctx, crds, opts, out, nil)
+	}()
+
+	for c := range out {
 		cards = append(cards, c)
 	}
 
-	return &cards
+	return &cards, <-errc
+}
+
+// StreamCardsForExporting exports the cards one at a time sending each on out
+// as soon as it's done and closes out once finished. The cards which imported
+// returns true for are only sent with their name, link and position. Once ctx
+// is cancelled it stops before the next card and returns errInterrupted
+func StreamCardsForExporting(ctx context.Context, crds *[]trello.Card, opts *TrelloOptions, out chan<- Card, imported func(url string) bool) error {
+	defer close(out)
+
+	for i := range *crds {
+		if ctx.Err() != nil {
+			return errInterrupted
+		}
+
+		card := &(*crds)[i]
+
+		if imported != nil && imported(card.ShortUrl) {
+			out <- Card{
+				ID:           card.Id,
+				Name:         card.Name,
+				ShortURL:     card.ShortUrl,
+				Position:     card.Pos,
+				ListPosition: opts.ListPosition(card.IdList),
+			}
+			continue
+		}
+
+		out <- exportCard(card, opts)
+	}
+
+	return nil
+}
+
+// exportCard makes the api calls to trello for everything
+// about the card, uploading the attachments to dropbox
+func exportCard(card *trello.Card, opts *TrelloOptions) Card {
+	var c Card
+
+	c.ID = card.Id
+	c.LastActivity = card.DateLastActivity
+	c.Name = card.Name
+	c.Desc = card.Desc
+	c.Labels = getLabelsFlattenFromCard(card)
+	if len(opts.LabelRules) > 0 {
+		c.Labels = opts.LabelRules.Apply(c.Labels, opts.Board.Name, opts.ListName(card.IdList))
+	}
+	c.DueDate = parseDateOrReturnNil(card.Due)
+	c.DueComplete, c.StartDate = getDueCompleteAndStartForCard(card)
+	c.IDCreator, c.CreatedAt, c.Comments = getCommentsAndCardCreator(card)
+	c.Tasks = getCheckListsForCard(card)
+	c.Position = card.Pos
+	c.ListPosition = opts.ListPosition(card.IdList)
+	c.ShortURL = card.ShortUrl
+	c.IDList = card.IdList
+	c.Archived = card.Closed || opts.IsListArchived(card.IdList)
+	c.IDOwners = card.IdMembers
+	c.IDFollowers = getFollowersForCard(card, &c, opts)
+
+	if len(opts.EstimatePatterns) > 0 {
+		c.Name, c.Estimate = parseEstimateFromName(c.Name, opts.EstimatePatterns)
+	}
+
+	if opts.ProcessImages {
+		var migrated map[string]string
+		c.Attachments, migrated, c.AttachmentsFound = downloadCardAttachmentsUploadToDropbox(card)
+
+		c.Desc = rewriteAttachmentURLs(c.Desc, migrated)
+		for i := range c.Comments {
+			c.Comments[i].Text = rewriteAttachmentURLs(c.Comments[i].Text, migrated)
+		}
+	}
+
+	if opts.AddTimelineComment {
+		c.Timeline = getTimelineForCard(card)
+	}
+
+	if len(opts.CustomFieldDefs) > 0 {
+		c.CustomFields = getCustomFieldsForCard(card, opts.CustomFieldDefs)
+	}
+
+	return c
 }
 
 func getCommentsAndCardCreator(card *trello.Card) (string, *time.Time, []Comment) {
@@ -81,7 +237,7 @@ func getCommentsAndCardCreator(card *trello.Card) (string, *time.Time, []Comment
 
 	actions, err := card.Actions()
 	if err != nil {
-		fmt.Println("Error: Querying the actions for:", card.Name, "ignoring...", err)
+		recordCardError(stageExport, card.Name, card.ShortUrl, fmt.Errorf("querying the actions: %s", err))
 	}
 
 	for _, a := range actions {
@@ -103,15 +259,119 @@ func getCommentsAndCardCreator(card *trello.Card) (string, *time.Time, []Comment
 	return creator, createdAt, comments
 }
 
+// getFollowersForCard returns the members who commented on the card and the
+// current user if subscribed, trello only exposes the subscription of the
+// authenticated member so other watchers of the card can't be fetched
+func getFollowersForCard(card *trello.Card, c *Card, opts *TrelloOptions) []string {
+	var followers []string
+
+	if card.Subscribed && opts.User != nil {
+		followers = append(followers, opts.User.Id)
+	}
+
+	for _, cm := range c.Comments {
+		followers = append(followers, cm.IDCreator)
+	}
+
+	return followers
+}
+
+func getTimelineForCard(card *trello.Card) []TimelineEvent {
+	var events []TimelineEvent
+	var actions []timelineAction
+
+	params := url.Values{}
+	params.Set("filter", "updateCard,addMemberToCard,removeMemberFromCard")
+	params.Set("limit", "1000")
+
+	err := getTrelloResource("/cards/"+card.Id+"/actions", params, &actions)
+	if err != nil {
+		recordCardError(stageExport, card.Name, card.ShortUrl, fmt.Errorf("querying the timeline: %s", err))
+	}
+
+	// Trello returns the newest actions first so walk them backwards
+	for i := len(actions) - 1; i >= 0; i-- {
+		a := actions[i]
+		e := TimelineEvent{
+			IDCreator:   a.MemberCreator.ID,
+			CreatorName: a.MemberCreator.FullName,
+			IDMember:    a.Member.ID,
+			MemberName:  a.Member.FullName,
+			CreatedAt:   parseDateOrReturnNil(a.Date),
+		}
+
+		switch a.Type {
+		case "addMemberToCard":
+			e.Text = "added to the card"
+		case "removeMemberFromCard":
+			e.Text = "removed from the card"
+		case "updateCard":
+			// Only list moves and due date changes are kept from the card updates
+			if _, ok := a.Data.Old["idList"]; ok {
+				e.Text = fmt.Sprintf("moved from %q to %q", a.Data.ListBefore.Name, a.Data.ListAfter.Name)
+			} else if _, ok := a.Data.Old["due"]; ok {
+				e.Text = "due date " + formatTimelineDueDate(a.Data.Card.Due)
+			}
+		}
+
+		if e.Text != "" {
+			events = append(events, e)
+		}
+	}
+
+	return events
+}
+
+func formatTimelineDueDate(due *string) string {
+	if due == nil {
+		return "removed"
+	}
+
+	d := parseDateOrReturnNil(*due)
+	if d == nil {
+		return "changed"
+	}
+
+	return "set to " + d.Format(timelineDateLayout)
+}
+
+// getDueCompleteAndStartForCard queries the card fields
+// which the trello package doesn't decode
+func getDueCompleteAndStartForCard(card *trello.Card) (bool, *time.Time) {
+	var fields struct {
+		DueComplete bool   `json:"dueComplete"`
+		Start       string `json:"start"`
+	}
+
+	params := url.Values{}
+	params.Set("fields", "dueComplete,start")
+
+	err := getTrelloResource("/cards/"+card.Id, params, &fields)
+	if err != nil {
+		recordCardError(stageExport, card.Name, card.ShortUrl, fmt.Errorf("querying the due complete and start date: %s", err))
+	}
+
+	return fields.DueComplete, parseDateOrReturnNil(fields.Start)
+}
+
 func getCheckListsForCard(card *trello.Card) []Task {
 	var tasks []Task
+	var checklists []checklist
 
-	checklists, err := card.Checklists()
+	err := getTrelloResource("/cards/"+card.Id+"/checklists", nil, &checklists)
 	if err != nil {
-		fmt.Println("Error: Occurred querying checklists for:", card.Name, "ignoring...", err)
+		recordCardError(stageExport, card.Name, card.ShortUrl, fmt.Errorf("querying the checklists: %s", err))
 	}
 
+	sort.SliceStable(checklists, func(i, j int) bool {
+		return checklists[i].Pos < checklists[j].Pos
+	})
+
 	for _, cl := range checklists {
+		sort.SliceStable(cl.CheckItems, func(i, j int) bool {
+			return cl.CheckItems[i].Pos < cl.CheckItems[j].Pos
+		})
+
 		for _, i := range cl.CheckItems {
 			var completed bool
 			if i.State == "complete" {
@@ -121,6 +381,12 @@ func getCheckListsForCard(card *trello.Card) []Task {
 			t := Task{
 				Completed:   completed,
 				Description: fmt.Sprintf("%s - %s", cl.Name, i.Name),
+				ChecklistID: cl.ID,
+				Checklist:   cl.Name,
+				Name:        i.Name,
+				IDOwner:     i.IDMember,
+				DueDate:     parseDateOrReturnNil(i.Due),
+				Position:    i.Pos,
 			}
 
 			tasks = append(tasks, t)
@@ -130,11 +396,11 @@ func getCheckListsForCard(card *trello.Card) []Task {
 	return tasks
 }
 
-func getLabelsFlattenFromCard(card *trello.Card) []string {
-	var labels []string
+func getLabelsFlattenFromCard(card *trello.Card) []Label {
+	var labels []Label
 
 	for _, l := range card.Labels {
-		labels = append(labels, l.Name)
+		labels = append(labels, Label{Name: l.Name, Color: l.Color})
 	}
 
 	return labels
@@ -150,21 +416,47 @@ func parseDateOrReturnNil(strDate string) *time.Time {
 	return &d
 }
 
-func downloadCardAttachmentsUploadToDropbox(card *trello.Card) map[string]string {
+// createdAtFromTrelloID returns the creation time embedded in the first
+// four bytes of a trello id, or nil if the id isn't in the expected format
+func createdAtFromTrelloID(id string) *time.Time {
+	if len(id) < 8 {
+		return nil
+	}
+
+	secs, err := strconv.ParseInt(id[:8], 16, 64)
+	if err != nil {
+		return nil
+	}
+
+	d := time.Unix(secs, 0).UTC()
+	return &d
+}
+
+// downloadCardAttachmentsUploadToDropbox returns the shared links by file name,
+// the shared links by the original trello attachment url and the number of attachments.
+// An attachment which fails is recorded as a card error and the others still migrated
+func downloadCardAttachmentsUploadToDropbox(card *trello.Card) (map[string]string, map[string]string, int) {
 	sharedLinks := map[string]string{}
+	migratedURLs := map[string]string{}
 	d := dropbox.New(dropbox.NewConfig(dropboxToken))
 
 	attachments, err := card.Attachments()
 	if err != nil {
-		log.Fatal(err)
+		recordCardError(stageAttachments, card.Name, card.ShortUrl, fmt.Errorf("querying the attachments: %s", err))
+		return sharedLinks, migratedURLs, 0
 	}
 
 	for i, f := range attachments {
 		name := safeFileNameRegexp.ReplaceAllString(f.Name, "_")
 		path := fmt.Sprintf("/trello/%s/%s/%d%s%s", card.IdList, card.Id, i, "_", name)
 
-		io := downloadTrelloAttachment(&f)
-		_, err := d.Files.Upload(&dropbox.UploadInput{
+		io, err := downloadTrelloAttachment(&f)
+		if err != nil {
+			recordCardError(stageAttachments, card.Name, card.ShortUrl, err)
+			continue
+		}
+
+		_, err = d.Files.Upload(&dropbox.UploadInput{
 			Path:   path,
 			Mode:   dropbox.WriteModeAdd,
 			Reader: io,
@@ -174,29 +466,63 @@ func downloadCardAttachmentsUploadToDropbox(card *trello.Card) map[string]string
 		io.Close()
 
 		if err != nil {
-			fmt.Printf("Error occurred uploading file to dropbox continuing... %s\n", err)
+			recordCardError(stageAttachments, card.Name, card.ShortUrl, fmt.Errorf("uploading %s to dropbox: %s", f.Name, err))
 		} else {
 			// Must be success created a shared url
 			s := dropbox.CreateSharedLinkInput{path, false}
 			out, err := d.Sharing.CreateSharedLink(&s)
 			if err != nil {
-				fmt.Printf("Error occurred sharing file on dropbox continuing... %s\n", err)
+				recordCardError(stageAttachments, card.Name, card.ShortUrl, fmt.Errorf("sharing %s on dropbox: %s", f.Name, err))
 			} else {
 				sharedLinks[name] = out.URL
+				migratedURLs[f.Url] = out.URL
 			}
 		}
 	}
 
-	return sharedLinks
+	return sharedLinks, migratedURLs, len(attachments)
 }
 
-func downloadTrelloAttachment(attachment *trello.Attachment) io.ReadCloser {
-	resp, err := http.Get(attachment.Url)
-	//	defer resp.Body.Close()
+// rewriteAttachmentURLs replaces the trello attachment urls embedded in the
+// text with the migrated links, so inline images still work once the card
+// is deleted from trello. Dropbox links are switched to raw so they render
+func rewriteAttachmentURLs(text string, migrated map[string]string) string {
+	// Longest first so a url which is the prefix of another doesn't
+	// replace part of it, and the text is the same on every run
+	origs := make([]string, 0, len(migrated))
+	for orig := range migrated {
+		origs = append(origs, orig)
+	}
+
+	sort.Slice(origs, func(i, j int) bool {
+		if len(origs[i]) != len(origs[j]) {
+			return len(origs[i]) > len(origs[j])
+		}
+		return origs[i] < origs[j]
+	})
+
+	for _, orig := range origs {
+		link := strings.Replace(migrated[orig], "?dl=0", "?raw=1", 1)
+
+		text = strings.Replace(text, orig, link, -1)
+		if unescaped, err := url.PathUnescape(orig); err == nil && unescaped != orig {
+			text = strings.Replace(text, unescaped, link, -1)
+		}
+	}
+
+	return text
+}
 
+func downloadTrelloAttachment(attachment *trello.Attachment) (io.ReadCloser, error) {
+	resp, err := http.Get(attachment.Url)
 	if err != nil {
-		log.Fatalf("Error in download Trello attachment %s\n", err)
+		return nil, fmt.Errorf("downloading %s: %s", attachment.Name, err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("downloading %s: trello returned %s", attachment.Name, resp.Status)
 	}
 
-	return resp.Body
+	return resp.Body, nil
 }
@@ -0,0 +1,48 @@
+package main
+
+import "testing"
+
+func TestRewriteAttachmentURLs(t *testing.T) {
+	const img = "https://trello.com/1/cards/abc/attachments/1/download/my%20image.png"
+
+	tests := []struct {
+		name     string
+		text     string
+		migrated map[string]string
+		want     string
+	}{
+		{
+			name:     "no attachments",
+			text:     "![image](" + img + ")",
+			migrated: map[string]string{},
+			want:     "![image](" + img + ")",
+		},
+		{
+			name:     "dropbox link rendered raw",
+			text:     "![image](" + img + ")",
+			migrated: map[string]string{img: "https://www.dropbox.com/s/x/my%20image.png?dl=0"},
+			want:     "![image](https://www.dropbox.com/s/x/my%20image.png?raw=1)",
+		},
+		{
+			name:     "unescaped url",
+			text:     "see https://trello.com/1/cards/abc/attachments/1/download/my image.png",
+			migrated: map[string]string{img: "https://files.example.com/1"},
+			want:     "see https://files.example.com/1",
+		},
+		{
+			name: "url prefixed by another",
+			text: "https://trello.com/a/file.png https://trello.com/a/file.png.zip",
+			migrated: map[string]string{
+				"https://trello.com/a/file.png":     "https://files.example.com/png",
+				"https://trello.com/a/file.png.zip": "https://files.example.com/zip",
+			},
+			want: "https://files.example.com/png https://files.example.com/zip",
+		},
+	}
+
+	for _, tt := range tests {
+		if got := rewriteAttachmentURLs(tt.text, tt.migrated); got != tt.want {
+			t.Errorf("%s: rewriteAttachmentURLs() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
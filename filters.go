@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"time"
+
+	trello "github.com/jnormington/go-trello"
+)
+
+const filterDateLayout = "2006-01-02"
+
+// cardFilterNames are the filters in the order they are checked
+// and the order the excluded card counts are displayed
+var cardFilterNames = []string{
+	"include-label",
+	"exclude-label",
+	"member",
+	"created-after",
+	"created-before",
+	"activity-after",
+	"activity-before",
+	"name-regex",
+	"has-due",
+}
+
+// CardFilters decides which trello cards are migrated and
+// counts the cards each filter excluded
+type CardFilters struct {
+	IncludeLabels  []string
+	ExcludeLabels  []string
+	MemberIDs      []string
+	CreatedAfter   *time.Time
+	CreatedBefore  *time.Time
+	ActivityAfter  *time.Time
+	ActivityBefore *time.Time
+	NameRegex      *regexp.Regexp
+	HasDue         string
+
+	// The csv rows the filters were read from, kept
+	// so an export can apply the same filters again
+	Rows [][]string
+
+	Excluded map[string]int
+}
+
+// LoadCardFiltersFromCSV reads the card filters csv which has the columns
+// Filter and Value. Each label and member filter can be repeated, a card
+// is kept when it has any of the include labels and any of the members
+func LoadCardFiltersFromCSV(path string, members *[]trello.Member) (*CardFilters, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening card filters file: %s", err)
+	}
+
+	defer f.Close()
+
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("reading card filters file: %s", err)
+	}
+
+	return parseCardFilters(rows, members)
+}
+
+// parseCardFilters builds the card filters from the rows of the card filters csv
+func parseCardFilters(rows [][]string, members *[]trello.Member) (*CardFilters, error) {
+	var err error
+	cf := CardFilters{Rows: rows, Excluded: make(map[string]int)}
+
+	for i, row := range rows {
+		if i == 0 {
+			// Its the header row
+			continue
+		}
+
+		if len(row) != 2 || row[0] == "" {
+			continue
+		}
+
+		name, value := row[0], row[1]
+
+		switch name {
+		case "include-label":
+			cf.IncludeLabels = append(cf.IncludeLabels, value)
+		case "exclude-label":
+			cf.ExcludeLabels = append(cf.ExcludeLabels, value)
+		case "member":
+			var id string
+			id, err = trelloMemberIDByUsername(members, value)
+			cf.MemberIDs = append(cf.MemberIDs, id)
+		case "created-after":
+			cf.CreatedAfter, err = parseFilterDate(value, i)
+		case "created-before":
+			cf.CreatedBefore, err = parseFilterDate(value, i)
+		case "activity-after":
+			cf.ActivityAfter, err = parseFilterDate(value, i)
+		case "activity-before":
+			cf.ActivityBefore, err = parseFilterDate(value, i)
+		case "name-regex":
+			cf.NameRegex, err = regexp.Compile(value)
+			if err != nil {
+				err = fmt.Errorf("invalid regex on card filters line %d: %s", i+1, err)
+			}
+		case "has-due":
+			if value != "yes" && value != "no" {
+				err = fmt.Errorf("has-due must be yes or no on card filters line %d", i+1)
+			}
+			cf.HasDue = value
+		default:
+			err = fmt.Errorf("unknown filter '%s' on card filters line %d", name, i+1)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &cf, nil
+}
+
+func parseFilterDate(value string, line int) (*time.Time, error) {
+	d, err := time.Parse(filterDateLayout, value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid date on card filters line %d expected YYYY-MM-DD: %s", line+1, err)
+	}
+
+	return &d, nil
+}
+
+func trelloMemberIDByUsername(members *[]trello.Member, username string) (string, error) {
+	for _, m := range *members {
+		if m.Username == username {
+			return m.Id, nil
+		}
+	}
+
+	return "", fmt.Errorf("trello member '%s' in card filters is not a member of the board", username)
+}
+
+// Apply returns the cards which pass every filter
+func (cf *CardFilters) Apply(cards []trello.Card) []trello.Card {
+	var kept []trello.Card
+
+	for _, c := range cards {
+		if reason := cf.excludedBy(&c); reason != "" {
+			cf.Excluded[reason]++
+			continue
+		}
+
+		kept = append(kept, c)
+	}
+
+	return kept
+}
+
+// excludedBy returns the name of the first filter
+// which excludes the card or blank if it's kept
+func (cf *CardFilters) excludedBy(card *trello.Card) string {
+	var labels []string
+	for _, l := range card.Labels {
+		labels = append(labels, l.Name)
+	}
+
+	if len(cf.IncludeLabels) > 0 && !containsAny(labels, cf.IncludeLabels) {
+		return "include-label"
+	}
+
+	if containsAny(labels, cf.ExcludeLabels) {
+		return "exclude-label"
+	}
+
+	if len(cf.MemberIDs) > 0 && !containsAny(card.IdMembers, cf.MemberIDs) {
+		return "member"
+	}
+
+	created := createdAtFromTrelloID(card.Id)
+	if created != nil && cf.CreatedAfter != nil && created.Before(*cf.CreatedAfter) {
+		return "created-after"
+	}
+
+	if created != nil && cf.CreatedBefore != nil && !created.Before(*cf.CreatedBefore) {
+		return "created-before"
+	}
+
+	activity := parseDateOrReturnNil(card.DateLastActivity)
+	if activity != nil && cf.ActivityAfter != nil && activity.Before(*cf.ActivityAfter) {
+		return "activity-after"
+	}
+
+	if activity != nil && cf.ActivityBefore != nil && !activity.Before(*cf.ActivityBefore) {
+		return "activity-before"
+	}
+
+	if cf.NameRegex != nil && !cf.NameRegex.MatchString(card.Name) {
+		return "name-regex"
+	}
+
+	if (cf.HasDue == "yes" && card.Due == "") || (cf.HasDue == "no" && card.Due != "") {
+		return "has-due"
+	}
+
+	return ""
+}
+
+// WriteSummary writes how many cards each filter excluded
+func (cf *CardFilters) WriteSummary(w io.Writer) {
+	fmt.Fprintln(w, "Cards excluded by filter:")
+
+	for _, n := range cardFilterNames {
+		if cf.Excluded[n] > 0 {
+			fmt.Fprintf(w, "\t%s: %d\n", n, cf.Excluded[n])
+		}
+	}
+}
+
+func containsAny(values []string, want []string) bool {
+	for _, v := range values {
+		for _, w := range want {
+			if v == w {
+				return true
+			}
+		}
+	}
+
+	return false
+}
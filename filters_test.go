@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	trello "github.com/jnormington/go-trello"
+)
+
+func TestCardFiltersExcludedBy(t *testing.T) {
+	members := []trello.Member{{Id: "m1", Username: "alice"}, {Id: "m2", Username: "bob"}}
+
+	// Created 2020-01-01 with its last activity in 2021
+	const card = `{
+		"id": "5e0be1000000000000000000",
+		"name": "Fix the login page",
+		"idMembers": ["m1"],
+		"dateLastActivity": "2021-06-01T00:00:00.000Z",
+		"labels": [{"name": "bug"}, {"name": "web"}]
+	}`
+
+	tests := []struct {
+		filter string
+		value  string
+		want   string
+	}{
+		{filter: "include-label", value: "web"},
+		{filter: "include-label", value: "ops", want: "include-label"},
+		{filter: "exclude-label", value: "ops"},
+		{filter: "exclude-label", value: "bug", want: "exclude-label"},
+		{filter: "member", value: "alice"},
+		{filter: "member", value: "bob", want: "member"},
+		{filter: "created-after", value: "2019-12-31"},
+		{filter: "created-after", value: "2020-01-02", want: "created-after"},
+		{filter: "created-before", value: "2020-01-02"},
+		{filter: "created-before", value: "2020-01-01", want: "created-before"},
+		{filter: "activity-after", value: "2021-01-01"},
+		{filter: "activity-after", value: "2021-07-01", want: "activity-after"},
+		{filter: "activity-before", value: "2021-07-01"},
+		{filter: "activity-before", value: "2021-06-01", want: "activity-before"},
+		{filter: "name-regex", value: "(?i)login"},
+		{filter: "name-regex", value: "^Add", want: "name-regex"},
+		{filter: "has-due", value: "no"},
+		{filter: "has-due", value: "yes", want: "has-due"},
+	}
+
+	for _, tt := range tests {
+		cf, err := parseCardFilters([][]string{{"Filter", "Value"}, {tt.filter, tt.value}}, &members)
+		if err != nil {
+			t.Errorf("%s %s: parseCardFilters() error = %v", tt.filter, tt.value, err)
+			continue
+		}
+
+		var c trello.Card
+		if err := json.Unmarshal([]byte(card), &c); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := cf.excludedBy(&c); got != tt.want {
+			t.Errorf("%s %s: excludedBy() = %q, want %q", tt.filter, tt.value, got, tt.want)
+		}
+	}
+}
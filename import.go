@@ -2,6 +2,8 @@ package main
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 	"time"
 
 	ch "github.com/jnormington/clubhouse-go"
@@ -9,28 +11,234 @@ import (
 
 var outputFormat = "%-40s %-17s %s\n"
 
-// ImportCardsIntoClubhouse takes *[]Card, *ClubhouseOptions and builds a clubhouse Story
-// this story from both the card and clubhouse options and creates via the api.
-func ImportCardsIntoClubhouse(cards *[]Card, opts *ClubhouseOptions, um *UserMap) {
+// importedStory links a created story to the position of the card it
+// was built from, without keeping the whole card once it's imported
+type importedStory struct {
+	Name         string
+	ShortURL     string
+	ListPosition float32
+	Position     float32
+	StoryID      int64
+	StateID      int64
+}
+
+func newImportedStory(ps *PlannedStory, storyID, stateID int64) importedStory {
+	return importedStory{
+		Name:         ps.CardName,
+		ShortURL:     ps.TrelloURL,
+		ListPosition: ps.ListPosition,
+		Position:     ps.Position,
+		StoryID:      storyID,
+		StateID:      stateID,
+	}
+}
+
+// planStory builds everything which will be created in clubhouse for the card
+func planStory(card *Card, opts *ClubhouseOptions, um *UserMap) PlannedStory {
+	ps := PlannedStory{
+		TrelloURL:        card.ShortURL,
+		CardName:         card.Name,
+		ListPosition:     card.ListPosition,
+		Position:         card.Position,
+		Story:            *buildClubhouseStory(card, opts, um),
+		ChecklistEpic:    opts.ChecklistMode == checklistToEpic && hasLargeChecklist(card, opts),
+		LinkedFiles:      card.Attachments,
+		CustomFields:     buildStoryCustomFields(card, opts),
+		ChecklistStories: buildChecklistStories(card, opts, um),
+		Report:           newReportRow(card, um),
+	}
+
+	ps.planEpic(card, opts)
+
+	return ps
+}
+
+// planEpic sets the epic of the first card label mapped to an epic, then the
+// epic of the card list. An epic created by the run isn't known until it runs
+// so the label or list is kept instead
+func (ps *PlannedStory) planEpic(card *Card, opts *ClubhouseOptions) {
+	for _, l := range card.Labels {
+		name := opts.LabelName(l)
+
+		if id, ok := opts.LabelEpics[name]; ok {
+			if id == 0 {
+				ps.LabelEpic = name
+			} else {
+				ps.Story.EpicID = &id
+			}
+
+			return
+		}
+	}
+
+	if id, ok := opts.ListEpics[card.IDList]; ok {
+		ps.Story.EpicID = &id
+		return
+	}
+
+	ps.ListEpic = card.IDList
+}
+
+// epicID returns the epic of the story once the epics of the run are created
+func (ps *PlannedStory) epicID(opts *ClubhouseOptions) *int64 {
+	if ps.Story.EpicID != nil {
+		return ps.Story.EpicID
+	}
+
+	if id := opts.LabelEpics[ps.LabelEpic]; ps.LabelEpic != "" && id != 0 {
+		return &id
+	}
+
+	if id, ok := opts.ListEpics[ps.ListEpic]; ok {
+		return &id
+	}
+
+	return nil
+}
+
+// planStories plans the story of each card as it arrives on the channel
+func planStories(cards <-chan Card, out chan<- PlannedStory, opts *ClubhouseOptions, um *UserMap) {
+	defer close(out)
+
+	for c := range cards {
+		out <- planStory(&c, opts, um)
+	}
+}
+
+// ImportCardsIntoClubhouse takes the planned stories as they arrive on the channel
+// and creates them with their epics, linked files, custom fields and checklist stories.
+// It returns a report row for every card with the result of the import once the
+// channel is closed, errors are recorded in the failures and the import continues
+// with the next card. Cards the run already imported are skipped
+func ImportCardsIntoClubhouse(stories <-chan PlannedStory, opts *ClubhouseOptions) []ReportRow {
 	fmt.Println("Importing trello cards into Clubhouse...")
 	fmt.Printf(outputFormat+"\n", "Trello Card Link", "Import Status", "Error/Story ID")
 
-	for _, c := range *cards {
+	var imported []importedStory
+	var rows []ReportRow
+
+	for planned := range stories {
+		ps := &planned
+		ui.CardStarted(ps.CardName, ps.TrelloURL)
+
+		if ic := opts.Run.FindImported(ps.TrelloURL); ic != nil {
+			// Still ordered with the new stories so the column keeps the trello order
+			imported = append(imported, newImportedStory(ps, ic.StoryID, ic.StateID))
+			fmt.Printf(outputFormat, ps.TrelloURL, "Skipped", fmt.Sprintf("Story ID: %d imported before resuming", ic.StoryID))
+			ui.CardImported(ps.CardName, ReportRow{TrelloURL: ps.TrelloURL, StoryID: ic.StoryID, Status: "Skipped"})
+			continue
+		}
+
+		row := ps.Report
+		story := ps.Story
+		story.EpicID = ps.epicID(opts)
+
+		story.LinkedFileIds = createLinkedFiles(ps, opts)
+
 		//We could use bulk update but lets give the user some prompt feedback
-		st, err := opts.ClubhouseEntry.CreateStory(*buildClubhouseStory(&c, opts, um))
+		st, err := opts.ClubhouseEntry.CreateStory(story)
 		if err != nil {
-			fmt.Printf(outputFormat, c.ShortURL, "Failed", err)
+			fmt.Printf(outputFormat, ps.TrelloURL, "Failed", err)
+			failures.Add(stageCreateStory, ps.CardName, ps.TrelloURL, err)
+			row.Status = "Failed"
+			row.addError(err)
+			rows = append(rows, row)
+			ui.CardImported(ps.CardName, row)
 			continue
 		}
 
-		fmt.Printf(outputFormat, c.ShortURL, "Success", fmt.Sprintf("Story ID: %d", st.ID))
+		opts.Run.RecordImport(ps.TrelloURL, st.ID, &story)
+
+		row.Status = "Success"
+		row.StoryID = st.ID
+		row.StoryURL = st.AppURL
+		row.CommentsMigrated = countTrelloComments(st.Comments)
+		row.TasksMigrated = len(story.Tasks)
+		row.LabelsMigrated = len(story.Labels)
+		row.AttachmentsMigrated = len(story.LinkedFileIds)
+
+		if row.CommentsMigrated < row.CommentsFound {
+			row.addError(fmt.Errorf("%d comments not migrated", row.CommentsFound-row.CommentsMigrated))
+		}
+
+		if row.AttachmentsMigrated < row.AttachmentsFound {
+			row.addError(fmt.Errorf("%d attachments not migrated", row.AttachmentsFound-row.AttachmentsMigrated))
+		}
+
+		if err := setStoryCustomFields(st.ID, ps.CustomFields); err != nil {
+			recordCardError(stageCustomFields, ps.CardName, ps.TrelloURL, err)
+			row.addError(err)
+		}
+
+		// A story already going in a label or list epic keeps it
+		// and its checklist stories go in the same epic
+		if ps.ChecklistEpic && story.EpicID == nil {
+			id, err := createChecklistEpic(st.ID, ps, opts)
+			if err != nil {
+				recordCardError(stageChecklistEpic, ps.CardName, ps.TrelloURL, err)
+				row.addError(err)
+			}
+
+			story.EpicID = id
+		}
+
+		created, errs := createChecklistStories(st.ID, story.EpicID, ps, opts)
+		row.TasksMigrated += created
+		for _, err := range errs {
+			recordCardError(stageChecklists, ps.CardName, ps.TrelloURL, err)
+			row.addError(err)
+		}
+
+		imported = append(imported, newImportedStory(ps, st.ID, story.WorkflowStateID))
+		rows = append(rows, row)
+		fmt.Printf(outputFormat, ps.TrelloURL, "Success", fmt.Sprintf("Story ID: %d", st.ID))
+		ui.CardImported(ps.CardName, row)
 	}
+
+	orderStoriesByTrelloPosition(imported)
+
+	return rows
 }
 
-func buildLinkFiles(card *Card, opts *ClubhouseOptions) []int64 {
+// orderStoriesByTrelloPosition moves each story after the previous one in
+// the same workflow state so the column keeps the trello card order
+func orderStoriesByTrelloPosition(imported []importedStory) {
+	if len(imported) < 2 {
+		return
+	}
+
+	fmt.Println("Ordering stories to match the trello card order...")
+
+	sort.SliceStable(imported, func(i, j int) bool {
+		a, b := imported[i], imported[j]
+		if a.ListPosition != b.ListPosition {
+			return a.ListPosition < b.ListPosition
+		}
+
+		return a.Position < b.Position
+	})
+
+	previous := map[int64]int64{}
+
+	for _, s := range imported {
+		if afterID, ok := previous[s.StateID]; ok {
+			body := map[string]int64{"after_id": afterID}
+
+			err := doClubhouseRequest("PUT", fmt.Sprintf("/stories/%d", s.StoryID), body, nil)
+			if err != nil {
+				recordCardError(stageOrdering, s.Name, s.ShortURL, err)
+			}
+		}
+
+		previous[s.StateID] = s.StoryID
+	}
+}
+
+// createLinkedFiles creates a linked file for each attachment uploaded to dropbox
+func createLinkedFiles(ps *PlannedStory, opts *ClubhouseOptions) []int64 {
 	ids := []int64{}
 
-	for k, v := range card.Attachments {
+	for k, v := range ps.LinkedFiles {
 		lf := ch.CreateLinkedFile{
 			Name:       k,
 			Type:       "url",
@@ -40,8 +248,9 @@ func buildLinkFiles(card *Card, opts *ClubhouseOptions) []int64 {
 
 		r, err := opts.ClubhouseEntry.CreateLinkedFiles(lf)
 		if err != nil {
-			fmt.Println("Fail to create linked file card name:", card.Name, "Dropbox link:", v, "Err:", err)
+			recordCardError(stageLinkedFiles, ps.CardName, ps.TrelloURL, fmt.Errorf("linking %s: %s", v, err))
 		} else {
+			opts.Run.RecordLinkedFile(r.ID)
 			ids = append(ids, r.ID)
 		}
 	}
@@ -53,26 +262,72 @@ func buildClubhouseStory(card *Card, opts *ClubhouseOptions, um *UserMap) *ch.Cr
 
 	return &ch.CreateStory{
 		ProjectID:       opts.Project.ID,
-		WorkflowStateID: opts.State.ID,
+		WorkflowStateID: buildWorkflowStateID(card, opts),
+		Archived:        card.Archived && opts.ArchivedState == nil,
 		RequestedByID:   um.GetCreator(card.IDCreator),
 		OwnerIds:        mapOwnersFromTrelloCard(card, um),
 		StoryType:       opts.StoryType,
-		FollowerIds:     []string{},
+		FollowerIds:     mapFollowersFromTrelloCard(card, um),
 		FileIds:         []int64{},
 
 		Name:        card.Name,
-		Description: card.Desc,
-		Deadline:    card.DueDate,
+		Estimate:    buildEstimate(card, opts),
+		Description: buildDescription(card, opts),
+		Deadline:    buildDeadline(card, opts),
 		CreatedAt:   card.CreatedAt,
 
-		Labels:   *buildLabels(card),
-		Tasks:    *buildTasks(card),
+		Labels:   *buildLabels(card, opts),
+		Tasks:    *buildTasks(card, opts, um),
 		Comments: *buildComments(card, opts.AddCommentWithTrelloLink, um),
 
-		LinkedFileIds: buildLinkFiles(card, opts),
+		LinkedFileIds: []int64{},
 	}
 }
 
+func buildWorkflowStateID(card *Card, opts *ClubhouseOptions) int64 {
+	if card.Archived && opts.ArchivedState != nil {
+		return opts.ArchivedState.ID
+	}
+
+	if card.DueComplete && opts.DueCompleteState != nil {
+		return opts.DueCompleteState.ID
+	}
+
+	if ls, ok := opts.ListStates[card.IDList]; ok {
+		return ls.State.ID
+	}
+
+	return opts.State.ID
+}
+
+func buildDeadline(card *Card, opts *ClubhouseOptions) *time.Time {
+	if card.DueComplete && opts.DropCompletedDeadline {
+		return nil
+	}
+
+	return card.DueDate
+}
+
+// buildDescription adds the start date header and
+// the custom fields table to the card description
+func buildDescription(card *Card, opts *ClubhouseOptions) string {
+	var parts []string
+
+	if card.StartDate != nil {
+		parts = append(parts, fmt.Sprintf("**Start date:** %s", card.StartDate.Format(filterDateLayout)))
+	}
+
+	if card.Desc != "" {
+		parts = append(parts, card.Desc)
+	}
+
+	if t := buildCustomFieldsTable(card, opts); t != "" {
+		parts = append(parts, t)
+	}
+
+	return strings.Join(parts, "\n\n")
+}
+
 func mapOwnersFromTrelloCard(c *Card, um *UserMap) []string {
 	owners := []string{}
 
@@ -83,6 +338,23 @@ func mapOwnersFromTrelloCard(c *Card, um *UserMap) []string {
 	return owners
 }
 
+// mapFollowersFromTrelloCard maps the card followers leaving out the backup
+// user, which unmapped members fall back to, and any duplicates
+func mapFollowersFromTrelloCard(c *Card, um *UserMap) []string {
+	followers := []string{}
+	seen := map[string]bool{um.BackupUserID: true}
+
+	for _, f := range c.IDFollowers {
+		id := um.GetCreator(f)
+		if !seen[id] {
+			seen[id] = true
+			followers = append(followers, id)
+		}
+	}
+
+	return followers
+}
+
 func buildComments(card *Card, addCommentWithTrelloLink bool, um *UserMap) *[]ch.CreateComment {
 	comments := []ch.CreateComment{}
 
@@ -96,6 +368,10 @@ func buildComments(card *Card, addCommentWithTrelloLink bool, um *UserMap) *[]ch
 		comments = append(comments, com)
 	}
 
+	if len(card.Timeline) > 0 {
+		comments = append(comments, buildTimelineComment(card, um))
+	}
+
 	if addCommentWithTrelloLink {
 		cc := ch.CreateComment{
 			CreatedAt: time.Now(),
@@ -108,13 +384,67 @@ func buildComments(card *Card, addCommentWithTrelloLink bool, um *UserMap) *[]ch
 	return &comments
 }
 
-func buildTasks(card *Card) *[]ch.CreateTask {
+func buildTimelineComment(card *Card, um *UserMap) ch.CreateComment {
+	lines := []string{"Trello card timeline:", ""}
+
+	for _, e := range card.Timeline {
+		var when string
+		if e.CreatedAt != nil {
+			when = e.CreatedAt.Format(timelineDateLayout)
+		}
+
+		author := um.GetMemberName(e.IDCreator, e.CreatorName)
+		text := e.Text
+
+		if e.IDMember != "" && e.IDMember != e.IDCreator {
+			text = fmt.Sprintf("%s %s", um.GetMemberName(e.IDMember, e.MemberName), e.Text)
+		}
+
+		lines = append(lines, fmt.Sprintf("- %s %s: %s", when, author, text))
+	}
+
+	return ch.CreateComment{
+		CreatedAt: time.Now(),
+		Text:      strings.Join(lines, "\n"),
+	}
+}
+
+// countTrelloComments counts the story comments leaving out
+// the timeline and trello link comments added by the import
+func countTrelloComments(comments []ch.Comment) int {
+	var n int
+	for _, c := range comments {
+		if strings.HasPrefix(c.Text, "Trello card timeline:") || strings.HasPrefix(c.Text, "Card imported from Trello:") {
+			continue
+		}
+
+		n++
+	}
+
+	return n
+}
+
+func buildTasks(card *Card, opts *ClubhouseOptions, um *UserMap) *[]ch.CreateTask {
 	tasks := []ch.CreateTask{}
 
 	for _, t := range card.Tasks {
+		if isLargeChecklist(card, t.ChecklistID, opts) {
+			continue
+		}
+
 		ts := ch.CreateTask{
 			Complete:    t.Completed,
 			Description: t.Description,
+			OwnerIds:    []string{},
+		}
+
+		// Clubhouse tasks have no due date so it's kept in the description
+		if t.DueDate != nil {
+			ts.Description = fmt.Sprintf("%s (due %s)", t.Description, t.DueDate.Format(filterDateLayout))
+		}
+
+		if t.IDOwner != "" {
+			ts.OwnerIds = append(ts.OwnerIds, um.GetCreator(t.IDOwner))
 		}
 
 		tasks = append(tasks, ts)
@@ -123,11 +453,39 @@ func buildTasks(card *Card) *[]ch.CreateTask {
 	return &tasks
 }
 
-func buildLabels(card *Card) *[]ch.CreateLabel {
+func buildLabels(card *Card, opts *ClubhouseOptions) *[]ch.CreateLabel {
 	labels := []ch.CreateLabel{}
+	seen := map[string]bool{}
 
 	for _, l := range card.Labels {
-		labels = append(labels, ch.CreateLabel{Name: l})
+		name := opts.LabelName(l)
+		if _, ok := opts.LabelEpics[name]; ok && opts.RemoveEpicLabels {
+			continue
+		}
+
+		// Clubhouse labels are matched on name so avoid sending the same one twice
+		if seen[strings.ToLower(name)] {
+			continue
+		}
+		seen[strings.ToLower(name)] = true
+
+		if e := opts.findExistingLabel(name); e != nil {
+			labels = append(labels, ch.CreateLabel{Name: e.Name})
+			continue
+		}
+
+		labels = append(labels, ch.CreateLabel{Name: name, Color: labelColorHex(l.Color)})
+	}
+
+	for _, l := range customFieldLabels(card, opts) {
+		if !seen[strings.ToLower(l)] {
+			seen[strings.ToLower(l)] = true
+			labels = append(labels, ch.CreateLabel{Name: l})
+		}
+	}
+
+	if card.Archived && opts.ArchivedState != nil && !seen[archivedLabel] {
+		labels = append(labels, ch.CreateLabel{Name: archivedLabel})
 	}
 
 	return &labels
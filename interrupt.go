@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// exitAborted is the exit code when a second signal stops the program straight away
+const exitAborted = 130
+
+var errInterrupted = errors.New("interrupted, stopped after the current card")
+
+// beforeExitAborted is called before a second signal exits straight away,
+// the full screen interface sets it to restore the output it captured
+var beforeExitAborted = func() {}
+
+// interruptRequests interrupts the run like a signal does. The full screen
+// interface reads Ctrl-C as a key press rather than a signal so sends it here
+var interruptRequests = make(chan os.Signal, 2)
+
+// requestInterrupt sends an interrupt request unless two are already waiting
+func requestInterrupt() {
+	select {
+	case interruptRequests <- os.Interrupt:
+	default:
+	}
+}
+
+// interruptContext returns a context which is cancelled by the first SIGINT
+// or SIGTERM so the card being migrated can finish before stopping. A second
+// signal exits straight away. Call stop to restore the default handling once
+// the cards are done, so the questions can still be left with Ctrl-C
+func interruptContext() (ctx context.Context, stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	done := make(chan struct{})
+
+	go func() {
+		select {
+		case <-signals:
+		case <-interruptRequests:
+		case <-done:
+			return
+		}
+
+		fmt.Println("\nInterrupted, finishing the current card... press Ctrl-C again to stop now")
+		cancel()
+
+		select {
+		case <-signals:
+		case <-interruptRequests:
+		case <-done:
+			return
+		}
+
+		fmt.Println("\nStopping now, the current card may be partly migrated")
+		beforeExitAborted()
+		os.Exit(exitAborted)
+	}()
+
+	return ctx, func() {
+		signal.Stop(signals)
+		close(done)
+		cancel()
+	}
+}
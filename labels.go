@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	ch "github.com/jnormington/clubhouse-go"
+)
+
+// trelloLabelColors maps the trello label color names to their hex value
+var trelloLabelColors = map[string]string{
+	"green":  "#61bd4f",
+	"yellow": "#f2d600",
+	"orange": "#ff9f1a",
+	"red":    "#eb5a46",
+	"purple": "#c377e0",
+	"blue":   "#0079bf",
+	"sky":    "#00c2e0",
+	"lime":   "#51e898",
+	"pink":   "#ff78cb",
+	"black":  "#344563",
+}
+
+func labelColorHex(color string) string {
+	return trelloLabelColors[color]
+}
+
+// LabelName returns the name the label is imported as, unnamed
+// color only labels use the name the user chose for the color
+func (co *ClubhouseOptions) LabelName(l Label) string {
+	if l.Name != "" {
+		return l.Name
+	}
+
+	if n := co.LabelColorNames[l.Color]; n != "" {
+		return n
+	}
+
+	return l.Color
+}
+
+func (co *ClubhouseOptions) getExistingLabels() error {
+	labels, err := co.ClubhouseEntry.ListLabels()
+	if err != nil {
+		return fmt.Errorf("querying the clubhouse labels: %s", err)
+	}
+
+	co.ExistingLabels = labels
+
+	return nil
+}
+
+// findExistingLabel matches a clubhouse label case insensitively
+// so we reuse it instead of creating a near duplicate
+func (co *ClubhouseOptions) findExistingLabel(name string) *ch.Label {
+	for i, l := range co.ExistingLabels {
+		if strings.EqualFold(l.Name, name) {
+			return &co.ExistingLabels[i]
+		}
+	}
+
+	return nil
+}
+
+func (co *ClubhouseOptions) promptUserForLabelColorNames(cards *[]Card) error {
+	for _, c := range *cards {
+		for _, l := range c.Labels {
+			if l.Name != "" {
+				continue
+			}
+
+			if _, ok := co.LabelColorNames[l.Color]; ok {
+				continue
+			}
+
+			question := fmt.Sprintf("Please type a label name for the unnamed '%s' trello labels (leave blank to use '%s')", l.Color, l.Color)
+			name, err := ui.Text(question)
+			if err != nil {
+				return err
+			}
+
+			co.LabelColorNames[l.Color] = name
+		}
+	}
+
+	return nil
+}
+
+func (co *ClubhouseOptions) uniqueLabelNamesFromCards(cards *[]Card) []string {
+	var labels []string
+	seen := map[string]bool{}
+
+	for _, c := range *cards {
+		for _, l := range c.Labels {
+			name := co.LabelName(l)
+			if !seen[name] {
+				seen[name] = true
+				labels = append(labels, name)
+			}
+		}
+	}
+
+	return labels
+}
+
+// LabelRule is a single row from the label rules csv
+type LabelRule struct {
+	Action string `json:"action"`
+	Match  string `json:"match"`
+	Value  string `json:"value"`
+	re     *regexp.Regexp
+}
+
+// UnmarshalJSON decodes a rule saved with an export or run, compiling its regex
+func (r *LabelRule) UnmarshalJSON(b []byte) error {
+	type rule LabelRule
+	if err := json.Unmarshal(b, (*rule)(r)); err != nil {
+		return err
+	}
+
+	var err error
+	if r.Action == "regex" || r.Action == "drop-regex" {
+		r.re, err = regexp.Compile(r.Match)
+	}
+
+	return err
+}
+
+// LabelRules are applied in order to the labels of every card
+type LabelRules []LabelRule
+
+// LoadLabelRulesFromCSV reads the label rules csv which has the columns
+// Action, Match and Value. The supported actions are
+//
+//	rename      Match the exact label name, Value the new name
+//	regex       Match a regular expression, Value the replacement ($1 expands)
+//	merge       Match label names separated by ; Value the merged name
+//	drop        Match the exact label name to remove
+//	drop-regex  Match a regular expression of the labels to remove
+//	add         Match the label to add to every story, {board} and {list}
+//	            are replaced with the trello board and list name
+func LoadLabelRulesFromCSV(path string) (LabelRules, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening label rules file: %s", err)
+	}
+
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+
+	rows, err := r.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("reading label rules file: %s", err)
+	}
+
+	var rules LabelRules
+	for i, row := range rows {
+		if i == 0 {
+			// Its the header row
+			continue
+		}
+
+		if len(row) < 2 || row[0] == "" {
+			continue
+		}
+
+		rule := LabelRule{Action: row[0], Match: row[1]}
+		if len(row) > 2 {
+			rule.Value = row[2]
+		}
+
+		switch rule.Action {
+		case "rename", "merge", "drop", "add":
+		case "regex", "drop-regex":
+			rule.re, err = regexp.Compile(rule.Match)
+			if err != nil {
+				return nil, fmt.Errorf("invalid regex on label rules line %d: %s", i+1, err)
+			}
+		default:
+			return nil, fmt.Errorf("unknown action '%s' on label rules line %d", rule.Action, i+1)
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// Apply rewrites the labels with every rule, adding the extra
+// labels last and removing any duplicates the rules produced
+func (rules LabelRules) Apply(labels []Label, boardName, listName string) []Label {
+	var out []Label
+	seen := map[string]bool{}
+
+	add := func(l Label) {
+		if l.Name != "" && seen[l.Name] {
+			return
+		}
+
+		seen[l.Name] = true
+		out = append(out, l)
+	}
+
+	for _, l := range labels {
+		if rules.rewrite(&l) {
+			add(l)
+		}
+	}
+
+	r := strings.NewReplacer("{board}", boardName, "{list}", listName)
+	for _, rule := range rules {
+		if rule.Action == "add" {
+			add(Label{Name: r.Replace(rule.Match)})
+		}
+	}
+
+	return out
+}
+
+// rewrite applies the rules to the label and returns false if it's dropped
+func (rules LabelRules) rewrite(l *Label) bool {
+	for _, rule := range rules {
+		switch rule.Action {
+		case "rename":
+			if l.Name == rule.Match {
+				l.Name = rule.Value
+			}
+		case "regex":
+			if rule.re.MatchString(l.Name) {
+				l.Name = rule.re.ReplaceAllString(l.Name, rule.Value)
+			}
+		case "merge":
+			for _, m := range strings.Split(rule.Match, ";") {
+				if l.Name == strings.TrimSpace(m) {
+					l.Name = rule.Value
+					break
+				}
+			}
+		case "drop":
+			if l.Name == rule.Match {
+				return false
+			}
+		case "drop-regex":
+			if rule.re.MatchString(l.Name) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
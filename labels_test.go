@@ -0,0 +1,67 @@
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestLabelRulesApply(t *testing.T) {
+	tests := []struct {
+		name   string
+		rules  LabelRules
+		labels []Label
+		want   []Label
+	}{
+		{
+			name:   "no rules",
+			labels: []Label{{Name: "bug", Color: "red"}},
+			want:   []Label{{Name: "bug", Color: "red"}},
+		},
+		{
+			name:   "rename keeps the color",
+			rules:  LabelRules{{Action: "rename", Match: "bug", Value: "defect"}},
+			labels: []Label{{Name: "bug", Color: "red"}, {Name: "ui"}},
+			want:   []Label{{Name: "defect", Color: "red"}, {Name: "ui"}},
+		},
+		{
+			name:   "regex",
+			rules:  LabelRules{{Action: "regex", Match: `^team-(\w+)$`, Value: "$1", re: regexp.MustCompile(`^team-(\w+)$`)}},
+			labels: []Label{{Name: "team-web"}, {Name: "bug"}},
+			want:   []Label{{Name: "web"}, {Name: "bug"}},
+		},
+		{
+			name:   "merge removes the duplicates",
+			rules:  LabelRules{{Action: "merge", Match: "bug; defect", Value: "bug"}},
+			labels: []Label{{Name: "bug", Color: "red"}, {Name: "defect", Color: "orange"}},
+			want:   []Label{{Name: "bug", Color: "red"}},
+		},
+		{
+			name: "drop and drop-regex",
+			rules: LabelRules{
+				{Action: "drop", Match: "wip"},
+				{Action: "drop-regex", Match: `^old-`, re: regexp.MustCompile(`^old-`)},
+			},
+			labels: []Label{{Name: "wip"}, {Name: "old-sprint"}, {Name: "bug"}},
+			want:   []Label{{Name: "bug"}},
+		},
+		{
+			name:   "rules apply in order",
+			rules:  LabelRules{{Action: "rename", Match: "bug", Value: "defect"}, {Action: "drop", Match: "defect"}},
+			labels: []Label{{Name: "bug"}},
+		},
+		{
+			name:   "add with the board and list",
+			rules:  LabelRules{{Action: "add", Match: "{board}/{list}"}, {Action: "add", Match: "bug"}},
+			labels: []Label{{Name: "bug", Color: "red"}},
+			want:   []Label{{Name: "bug", Color: "red"}, {Name: "Roadmap/Doing"}},
+		},
+	}
+
+	for _, tt := range tests {
+		got := tt.rules.Apply(tt.labels, "Roadmap", "Doing")
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Apply() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
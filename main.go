@@ -2,8 +2,9 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
-	"log"
 	"os"
 )
 
@@ -15,42 +16,103 @@ var (
 
 	stdinReader   = bufio.NewReader(os.Stdin)
 	errOutOfRange = "Number input is out of range. Try again"
+	errAborted    = errors.New("stopping user aborted at confirmation step")
 	yesNoOpts     = []string{"Yes", "No"}
 )
 
 func main() {
-	to := SetupTrelloOptionsFromUser()
-
-	c := to.getCards()
+	runCommand(os.Args[1:])
+}
 
-	cards := ProcessCardsForExporting(&c, to)
+// buildTrelloSummary returns the trello options the user selected for review in the plan
+func buildTrelloSummary(to *TrelloOptions) string {
+	var b bytes.Buffer
 
-	co := SetupClubhouseOptions()
-	um := NewUserMap(to, co)
-	um.SetupUserMapping()
+	fmt.Fprintf(&b, "Export cards from Trello\n\tBoard: %s\n\tList: %s\n\tLists as Epics: %s\n\tAdd Comment with Card Timeline: %t\n\tLabel Rules: %d\n\tInclude Archived: %t\n\tParse Estimates: %t\n\n",
+		to.Board.Name, to.ListNames(), to.EpicListNames(), to.AddTimelineComment, len(to.LabelRules), to.IncludeArchived,
+		len(to.EstimatePatterns) > 0)
 
-	confirmAllOptionsBeforeImport(to, co)
+	if to.CardFilters != nil {
+		to.CardFilters.WriteSummary(&b)
+		fmt.Fprintln(&b)
+	}
 
-	ImportCardsIntoClubhouse(cards, co, um)
-	fmt.Println("*** Looks like we finished go and have fun & joy with Clubhouse ***")
+	return b.String()
 }
 
-func confirmAllOptionsBeforeImport(to *TrelloOptions, co *ClubhouseOptions) {
-	fmt.Println("****** WARNING ******")
-	fmt.Println("Please review carefully before you continue")
-	fmt.Printf("\nExport cards from Trello\n\tBoard: %s\n\tList: %s\n\n\n", to.Board.Name, to.List.Name)
-	fmt.Printf("Import cards into clubhouse\n\tProject: %s\n\tWorkflow State: %s\n\tStory Type: %s\n\tAdd Comment with Trello Link: %t\n\n",
+// buildClubhouseSummary returns the clubhouse options the user selected for review in the plan
+func buildClubhouseSummary(co *ClubhouseOptions) string {
+	var b bytes.Buffer
+
+	fmt.Fprintf(&b, "Import cards into clubhouse\n\tProject: %s\n\tWorkflow State: %s\n\tStory Type: %s\n\tAdd Comment with Trello Link: %t\n",
 		co.Project.Name, co.State.Name, co.StoryType, co.AddCommentWithTrelloLink)
 
-	fmt.Println("Is the above correct select the number representing your answer ?")
+	for _, ls := range co.ListStates {
+		fmt.Fprintf(&b, "\tList '%s' to Workflow State: %s\n", ls.ListName, ls.State.Name)
+	}
 
-	for i, o := range yesNoOpts {
-		fmt.Printf("[%d] %s\n", i, o)
+	for l, id := range co.LabelEpics {
+		if id == 0 {
+			fmt.Fprintf(&b, "\tLabel '%s' to new epic\n", l)
+		} else {
+			fmt.Fprintf(&b, "\tLabel '%s' to epic ID: %d\n", l, id)
+		}
 	}
 
-	i := promptUserSelectResource()
+	fmt.Fprintf(&b, "\tRemove Labels mapped to Epics: %t\n", co.RemoveEpicLabels)
+
+	if co.ReportFormat != "" {
+		fmt.Fprintf(&b, "\tMigration Report: %s\n", co.ReportFormat)
+	}
 
-	if i != 0 {
-		log.Fatal("Stopping user aborted at confirmation step")
+	if co.DueCompleteState != nil {
+		fmt.Fprintf(&b, "\tCompleted Due Date Workflow State: %s\n", co.DueCompleteState.Name)
 	}
+
+	fmt.Fprintf(&b, "\tDrop Completed Deadlines: %t\n", co.DropCompletedDeadline)
+
+	if co.ChecklistThreshold > 0 {
+		fmt.Fprintf(&b, "\tChecklists above %d items as: %s\n", co.ChecklistThreshold, co.ChecklistMode)
+	}
+
+	if co.ArchivedState != nil {
+		fmt.Fprintf(&b, "\tArchived Cards Workflow State: %s\n", co.ArchivedState.Name)
+	} else {
+		fmt.Fprintf(&b, "\tArchived Cards Workflow State: archived stories\n")
+	}
+
+	return b.String()
+}
+
+// confirmBeforeMigrating asks to start the migration once the options are reviewed
+func confirmBeforeMigrating() error {
+	yes, err := promptUserYesNo("****** WARNING ******\n" +
+		"Please review the options above carefully before you continue\n" +
+		"Start the migration select the number representing your answer ?")
+	if err != nil {
+		return err
+	}
+
+	if !yes {
+		return errAborted
+	}
+
+	return nil
+}
+
+func confirmPlanBeforeApply(p *Plan) error {
+	yes, err := promptUserYesNo("****** WARNING ******\n" +
+		"Please review the plan file carefully before you continue\n" +
+		"Plan file: " + getPlanPath(p.PlanID) + "\n\n" +
+		"Apply the above plan select the number representing your answer ?")
+	if err != nil {
+		return err
+	}
+
+	if !yes {
+		fmt.Printf("The plan can be applied later with: apply %s\n", p.PlanID)
+		return errAborted
+	}
+
+	return nil
 }
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	ch "github.com/jnormington/clubhouse-go"
+	trello "github.com/jnormington/go-trello"
+)
+
+// pipelineBuffer is how many exported cards can wait to be imported, the
+// export of the next cards pauses until the import catches up
+const pipelineBuffer = 2
+
+// cardScan holds the fields of a card the clubhouse questions depend
+// on, which trello returns for the whole board in a single request
+type cardScan struct {
+	ID          string `json:"id"`
+	DueComplete bool   `json:"dueComplete"`
+	Checklists  []struct {
+		ID         string `json:"id"`
+		Name       string `json:"name"`
+		CheckItems []struct {
+			Name string `json:"name"`
+		} `json:"checkItems"`
+	} `json:"checklists"`
+	CustomFieldItems []trelloCustomFieldItem `json:"customFieldItems"`
+}
+
+// Migrate asks all of the questions up front and then exports each card and
+// imports it straight away, so only the cards in flight are held in memory.
+// Given the id of an interrupted migrate run it skips the cards already imported
+func Migrate(sel *Selection, resumeRunID string) error {
+	var rl *RunLog
+	if resumeRunID != "" {
+		var err error
+		if rl, err = LoadRunLog(resumeRunID); err != nil {
+			return err
+		}
+	}
+
+	to, err := SetupTrelloOptionsFromUser(sel)
+	if err != nil {
+		return err
+	}
+
+	cards, err := to.getCards()
+	if err != nil {
+		return err
+	}
+
+	members, err := to.ListMembers()
+	if err != nil {
+		return err
+	}
+
+	preview, err := previewCardsForQuestions(cards, to)
+	if err != nil {
+		return err
+	}
+
+	co, err := SetupClubhouseOptions(&preview, to.Lists, sel)
+	if err != nil {
+		return err
+	}
+
+	um, err := NewUserMap(members, co)
+	if err != nil {
+		return err
+	}
+
+	if err := ui.MapUsers(um); err != nil {
+		return err
+	}
+
+	fmt.Printf("\n%s\n%s\n", buildTrelloSummary(to), buildClubhouseSummary(co))
+	fmt.Printf("%d cards will be migrated\n\n", len(cards))
+
+	if err := confirmBeforeMigrating(); err != nil {
+		return err
+	}
+
+	src := &Export{
+		BoardName: to.Board.Name,
+		BoardURL:  to.Board.Url,
+		Lists:     to.Lists,
+		EpicLists: to.EpicLists,
+
+		LabelRules:       to.LabelRules,
+		EstimatePatterns: to.EstimatePatterns,
+		ProcessImages:    to.ProcessImages,
+	}
+
+	if rl == nil {
+		if rl, err = NewRunLog(""); err != nil {
+			return err
+		}
+	}
+
+	rl.RecordOptions(src, co, um)
+
+	// Taken before the export starts as the import adds to the run log while it runs
+	imported := map[string]bool{}
+	for _, ic := range rl.Imported {
+		imported[ic.TrelloURL] = true
+	}
+
+	return importIntoClubhouse(src, len(cards), co, rl, func(ctx context.Context, out chan<- PlannedStory) error {
+		exported := make(chan Card)
+		go planStories(exported, out, co, um)
+
+		return StreamCardsForExporting(ctx, &cards, to, exported, func(u string) bool {
+			return imported[u]
+		})
+	})
+}
+
+// importIntoClubhouse creates the epics then imports the stories sent by produce
+// as they arrive. The first signal stops produce before its next card, the stories
+// already produced are still imported and how to resume the run is printed
+func importIntoClubhouse(src *Export, total int, co *ClubhouseOptions, rl *RunLog, produce func(context.Context, chan<- PlannedStory) error) error {
+	co.ClubhouseEntry = ch.New(clubHouseToken)
+	co.Run = rl
+
+	if len(rl.Imported) > 0 {
+		fmt.Printf("Resuming Run ID: %s with %d cards already imported\n", rl.RunID, len(rl.Imported))
+	} else {
+		fmt.Printf("Run ID: %s\n", rl.RunID)
+	}
+
+	ctx, stop := interruptContext()
+	defer stop()
+
+	ui.StartProgress(total)
+
+	if err := co.CreateLabelEpics(); err != nil {
+		return err
+	}
+
+	if len(src.EpicLists) > 0 {
+		if err := co.CreateListEpics(src.epicLists(), src.BoardName, src.BoardURL); err != nil {
+			return err
+		}
+	}
+
+	stories := make(chan PlannedStory, pipelineBuffer)
+	errc := make(chan error, 1)
+
+	go func() {
+		errc <- produce(ctx, stories)
+	}()
+
+	rows := ImportCardsIntoClubhouse(stories, co)
+	err := <-errc
+
+	if co.ReportFormat != "" {
+		path, err := WriteMigrationReport(rows, co.ReportFormat)
+		if err != nil {
+			fmt.Println("Error: writing the migration report:", err)
+		} else {
+			fmt.Printf("Migration report written to: %s\n", path)
+		}
+	}
+
+	if err == errInterrupted {
+		fmt.Printf("Imported %d of %d cards, progress is saved in: %s\n", len(rl.Imported), total, getRunLogPath(rl.RunID))
+		if rl.PlanID != "" {
+			fmt.Printf("To resume this run use: apply -resume %s\n", rl.RunID)
+		} else {
+			fmt.Printf("To resume this run use: migrate -resume %s and answer the same questions\n", rl.RunID)
+		}
+		fmt.Printf("To undo this run use: rollback %s\n", rl.RunID)
+		return err
+	}
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("To verify this run use: verify %s\n", rl.RunID)
+	fmt.Printf("To undo this run use: rollback %s\n", rl.RunID)
+
+	if len(failures.Errors) > 0 {
+		fmt.Println("*** Finished with errors, see the failures below ***")
+		return nil
+	}
+
+	fmt.Println("*** Looks like we finished go and have fun & joy with Clubhouse ***")
+	return nil
+}
+
+// feedStories sends the planned stories on out until ctx is cancelled
+func feedStories(ctx context.Context, stories []PlannedStory, out chan<- PlannedStory) error {
+	defer close(out)
+
+	for _, ps := range stories {
+		if ctx.Err() != nil {
+			return errInterrupted
+		}
+
+		out <- ps
+	}
+
+	return nil
+}
+
+// previewCardsForQuestions returns the cards with only the labels, archived
+// and due complete state, checklists and custom fields filled in. That's all
+// the clubhouse questions need, so they can be asked before exporting anything
+func previewCardsForQuestions(cards []trello.Card, opts *TrelloOptions) ([]Card, error) {
+	fmt.Println("Please wait while we scan the board...")
+
+	var scans []cardScan
+
+	params := url.Values{}
+	params.Set("fields", "dueComplete")
+	params.Set("checklists", "all")
+	params.Set("checklist_fields", "name")
+	params.Set("customFieldItems", "true")
+
+	err := getTrelloResource("/boards/"+opts.Board.Id+"/cards/all", params, &scans)
+	if err != nil {
+		return nil, fmt.Errorf("scanning the board cards: %s", err)
+	}
+
+	byID := map[string]*cardScan{}
+	for i := range scans {
+		byID[scans[i].ID] = &scans[i]
+	}
+
+	var preview []Card
+	for i := range cards {
+		card := &cards[i]
+
+		c := Card{
+			ID:       card.Id,
+			Name:     card.Name,
+			ShortURL: card.ShortUrl,
+			Labels:   getLabelsFlattenFromCard(card),
+			Archived: card.Closed || opts.IsListArchived(card.IdList),
+		}
+
+		if len(opts.LabelRules) > 0 {
+			c.Labels = opts.LabelRules.Apply(c.Labels, opts.Board.Name, opts.ListName(card.IdList))
+		}
+
+		if s, ok := byID[card.Id]; ok {
+			c.DueComplete = s.DueComplete
+
+			for _, cl := range s.Checklists {
+				for _, item := range cl.CheckItems {
+					c.Tasks = append(c.Tasks, Task{ChecklistID: cl.ID, Checklist: cl.Name, Name: item.Name})
+				}
+			}
+
+			for _, item := range s.CustomFieldItems {
+				for _, d := range opts.CustomFieldDefs {
+					if d.ID != item.IDCustomField {
+						continue
+					}
+
+					if v := customFieldItemValue(&d, &item); v != "" {
+						c.CustomFields = append(c.CustomFields, CustomField{Name: d.Name, Value: v})
+					}
+				}
+			}
+		}
+
+		preview = append(preview, c)
+	}
+
+	return preview, nil
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"time"
+
+	ch "github.com/jnormington/clubhouse-go"
+	trello "github.com/jnormington/go-trello"
+)
+
+// Export is the cards exported from trello with the details of
+// the board and lists needed to import them without trello
+type Export struct {
+	ExportID  string    `json:"export_id"`
+	CreatedAt time.Time `json:"created_at"`
+	Summary   string    `json:"summary"`
+
+	BoardName       string          `json:"board_name"`
+	BoardURL        string          `json:"board_url"`
+	Lists           []trello.List   `json:"lists"`
+	EpicLists       []string        `json:"epic_lists"`
+	IncludeArchived bool            `json:"include_archived"`
+	CardFilters     [][]string      `json:"card_filters"`
+	Members         []trello.Member `json:"members"`
+	Cards           []Card          `json:"cards"`
+
+	// How the cards were exported, kept so a run can be verified the same way
+	LabelRules       LabelRules        `json:"label_rules"`
+	EstimatePatterns []EstimatePattern `json:"estimate_patterns"`
+	ProcessImages    bool              `json:"process_images"`
+}
+
+// Plan is everything resolved by the interactive questions and the exported
+// cards, written to a file for review and applied without any more questions
+type Plan struct {
+	PlanID    string    `json:"plan_id"`
+	CreatedAt time.Time `json:"created_at"`
+	Summary   string    `json:"summary"`
+
+	Source  *Export           `json:"source"`
+	Options *ClubhouseOptions `json:"options"`
+	Users   *UserMap          `json:"users"`
+	Stories []PlannedStory    `json:"stories"`
+}
+
+// PlannedStory is everything which will be created for a trello card. The new
+// epics aren't created until the plan is applied, so a story going in one of them
+// has the label or list of the epic instead of an epic id
+type PlannedStory struct {
+	TrelloURL    string  `json:"trello_url"`
+	CardName     string  `json:"card_name"`
+	ListPosition float32 `json:"list_position"`
+	Position     float32 `json:"position"`
+
+	Story            ch.CreateStory     `json:"story"`
+	LabelEpic        string             `json:"label_epic,omitempty"`
+	ListEpic         string             `json:"list_epic,omitempty"`
+	ChecklistEpic    bool               `json:"checklist_epic"`
+	LinkedFiles      map[string]string  `json:"linked_files"`
+	CustomFields     []StoryCustomField `json:"custom_fields"`
+	ChecklistStories []ch.CreateStory   `json:"checklist_stories"`
+
+	// The report row with the counts found on the trello card
+	Report ReportRow `json:"report"`
+}
+
+// ExportFromTrello asks the trello questions and exports the cards
+func ExportFromTrello(sel *Selection) (*Export, error) {
+	to, err := SetupTrelloOptionsFromUser(sel)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := to.getCards()
+	if err != nil {
+		return nil, err
+	}
+
+	members, err := to.ListMembers()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, stop := interruptContext()
+	cards, err := ProcessCardsForExporting(ctx, &c, to)
+	stop()
+
+	if err == errInterrupted {
+		fmt.Printf("Exported %d of %d cards, the export wasn't saved so run it again to export all the cards\n", len(*cards), len(c))
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var filters [][]string
+	if to.CardFilters != nil {
+		filters = to.CardFilters.Rows
+	}
+
+	now := time.Now()
+	return &Export{
+		ExportID:        now.Format(runIDLayout),
+		CreatedAt:       now,
+		Summary:         buildTrelloSummary(to),
+		BoardName:       to.Board.Name,
+		BoardURL:        to.Board.Url,
+		Lists:           to.Lists,
+		EpicLists:       to.EpicLists,
+		IncludeArchived: to.IncludeArchived,
+		CardFilters:     filters,
+		Members:         *members,
+		Cards:           *cards,
+
+		LabelRules:       to.LabelRules,
+		EstimatePatterns: to.EstimatePatterns,
+		ProcessImages:    to.ProcessImages,
+	}, nil
+}
+
+// epicLists returns the exported lists which become epics
+func (e *Export) epicLists() []trello.List {
+	var lists []trello.List
+
+	for _, l := range e.Lists {
+		for _, id := range e.EpicLists {
+			if l.Id == id {
+				lists = append(lists, l)
+			}
+		}
+	}
+
+	return lists
+}
+
+// LoadExport reads an export file by its id
+func LoadExport(exportID string) (*Export, error) {
+	b, err := ioutil.ReadFile(getExportPath(exportID))
+	if err != nil {
+		return nil, fmt.Errorf("reading the export %s: %s", exportID, err)
+	}
+
+	var e Export
+	if err := json.Unmarshal(b, &e); err != nil {
+		return nil, fmt.Errorf("parsing the export %s: %s", exportID, err)
+	}
+
+	return &e, nil
+}
+
+func getExportPath(exportID string) string {
+	return getWorkingDirFilePath(fmt.Sprintf("trelloExport-%s.json", exportID))
+}
+
+// Save writes the export to a file and returns the path of the file
+func (e *Export) Save() (string, error) {
+	return getExportPath(e.ExportID), writeJSONFile(getExportPath(e.ExportID), e, "export")
+}
+
+// CreatePlan asks the clubhouse and user mapping questions
+// for the exported cards and writes the plan file for review
+func CreatePlan(e *Export, sel *Selection) (*Plan, error) {
+	co, err := SetupClubhouseOptions(&e.Cards, e.Lists, sel)
+	if err != nil {
+		return nil, err
+	}
+
+	um, err := NewUserMap(&e.Members, co)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := um.SetupUserMapping(); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	p := Plan{
+		PlanID:    now.Format(runIDLayout),
+		CreatedAt: now,
+		Summary:   e.Summary + "\n" + buildClubhouseSummary(co),
+		Source:    e,
+		Options:   co,
+		Users:     um,
+	}
+
+	for i := range e.Cards {
+		p.Stories = append(p.Stories, planStory(&e.Cards[i], co, um))
+	}
+
+	if err := writeJSONFile(getPlanPath(p.PlanID), &p, "plan"); err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("\n%s\n", p.Summary)
+	fmt.Printf("Plan %s written with %d stories to: %s\n", p.PlanID, len(p.Stories), getPlanPath(p.PlanID))
+
+	return &p, nil
+}
+
+// ApplyPlan creates the epics and the stories exactly as written in the plan,
+// refusing to continue if the trello cards changed since the plan was made.
+// Errors for single cards are recorded in the failures and don't stop it.
+// Given the log of an interrupted run it resumes that run instead of starting a new one
+func ApplyPlan(p *Plan, rl *RunLog) error {
+	changes, err := p.sourceChanges()
+	if err != nil {
+		return err
+	}
+
+	if len(changes) > 0 {
+		fmt.Println("The trello source has changed since the plan was made:")
+		for _, c := range changes {
+			fmt.Printf("\t%s\n", c)
+		}
+
+		return errors.New("refusing to apply the plan, please create a new plan")
+	}
+
+	if rl == nil {
+		if rl, err = NewRunLog(p.PlanID); err != nil {
+			return err
+		}
+	}
+
+	rl.RecordOptions(p.Source, p.Options, p.Users)
+
+	return importIntoClubhouse(p.Source, len(p.Stories), p.Options, rl, func(ctx context.Context, out chan<- PlannedStory) error {
+		return feedStories(ctx, p.Stories, out)
+	})
+}
+
+// LoadPlan reads a plan file by its id
+func LoadPlan(planID string) (*Plan, error) {
+	b, err := ioutil.ReadFile(getPlanPath(planID))
+	if err != nil {
+		return nil, fmt.Errorf("reading the plan %s: %s", planID, err)
+	}
+
+	var p Plan
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, fmt.Errorf("parsing the plan %s: %s", planID, err)
+	}
+
+	return &p, nil
+}
+
+func getPlanPath(planID string) string {
+	return getWorkingDirFilePath(fmt.Sprintf("migrationPlan-%s.json", planID))
+}
+
+func writeJSONFile(path string, v interface{}, name string) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding the %s: %s", name, err)
+	}
+
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		return fmt.Errorf("writing the %s: %s", name, err)
+	}
+
+	return nil
+}
+
+// sourceChanges returns the planned cards which were changed, moved out of the
+// planned lists or deleted, and the cards the export filters would migrate
+// which were added to or moved into the planned lists since the export
+func (p *Plan) sourceChanges() ([]string, error) {
+	var changes []string
+
+	var filters *CardFilters
+	if len(p.Source.CardFilters) > 0 {
+		var err error
+		if filters, err = parseCardFilters(p.Source.CardFilters, &p.Source.Members); err != nil {
+			return nil, err
+		}
+	}
+
+	planned := map[string]*Card{}
+	for i, c := range p.Source.Cards {
+		planned[c.ID] = &p.Source.Cards[i]
+	}
+
+	found := map[string]bool{}
+	unread := map[string]bool{}
+
+	params := url.Values{}
+	params.Set("filter", "open")
+	params.Set("fields", "id,name,idMembers,labels,dateLastActivity,due,shortUrl")
+
+	if p.Source.IncludeArchived {
+		params.Set("filter", "all")
+	}
+
+	for _, l := range p.Source.Lists {
+		var cards []trello.Card
+
+		if err := getTrelloResource("/lists/"+l.Id+"/cards", params, &cards); err != nil {
+			changes = append(changes, fmt.Sprintf("list %s could not be read: %s", l.Name, err))
+			unread[l.Id] = true
+			continue
+		}
+
+		for i := range cards {
+			c := &cards[i]
+
+			if pc, ok := planned[c.Id]; ok {
+				found[c.Id] = true
+
+				if c.DateLastActivity != pc.LastActivity {
+					changes = append(changes, fmt.Sprintf("%s was changed at %s", c.ShortUrl, c.DateLastActivity))
+				}
+
+				continue
+			}
+
+			if filters == nil || filters.excludedBy(c) == "" {
+				changes = append(changes, fmt.Sprintf("%s was added to or moved into the list %s", c.ShortUrl, l.Name))
+			}
+		}
+	}
+
+	for _, c := range p.Source.Cards {
+		if !found[c.ID] && !unread[c.IDList] {
+			changes = append(changes, fmt.Sprintf("%s was moved out of the planned lists, archived or deleted", c.ShortURL))
+		}
+	}
+
+	return changes, nil
+}
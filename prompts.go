@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const errNotANumber = "Hmm... did you type a number ? Try again"
+
+// promptUserSelectFromList lists the options by number and reads the number
+// of one. Typing anything else lists only the options containing the text so
+// long lists can be searched, and a blank answer lists all of them again
+func promptUserSelectFromList(options []string) (int, error) {
+	printOptions(options, "")
+
+	for {
+		s, err := promptUserForText()
+		if err != nil {
+			return 0, err
+		}
+
+		i, err := strconv.Atoi(s)
+		if err != nil {
+			printOptions(options, s)
+			continue
+		}
+
+		if i >= 0 && i < len(options) {
+			return i, nil
+		}
+
+		fmt.Println(errOutOfRange)
+	}
+}
+
+// promptUserSelectManyFromList is promptUserSelectFromList for a choice which
+// accepts multiple values, read as numbers and ranges like 1,3,5-7
+func promptUserSelectManyFromList(options []string) ([]int, error) {
+	printOptions(options, "")
+	fmt.Println("Type one or more numbers like 1,3,5-7")
+
+	for {
+		s, err := promptUserForText()
+		if err != nil {
+			return nil, err
+		}
+
+		if s == "" || strings.IndexFunc(s, isSearchRune) >= 0 {
+			printOptions(options, s)
+			continue
+		}
+
+		selected, err := parseSelection(s, len(options))
+		if err == nil {
+			return selected, nil
+		}
+
+		fmt.Printf("Hmm... %s. Try again\n", err)
+	}
+}
+
+// isSearchRune returns whether the rune can't be part of a selection like 1,3,5-7
+func isSearchRune(r rune) bool {
+	return !strings.ContainsRune("0123456789,- ", r)
+}
+
+// printOptions lists the options containing the search text ignoring case,
+// with the number of each option in the full list
+func printOptions(options []string, search string) {
+	var found int
+
+	for i, o := range options {
+		if search != "" && !strings.Contains(strings.ToLower(o), strings.ToLower(search)) {
+			continue
+		}
+
+		fmt.Printf("[%d] %s\n", i, o)
+		found++
+	}
+
+	if found == 0 {
+		fmt.Printf("Nothing matches '%s', leave blank to list everything\n", search)
+	}
+}
+
+// parseSelection parses numbers and ranges like 1,3,5-7 of the n options,
+// returning every selected number once in order
+func parseSelection(s string, n int) ([]int, error) {
+	seen := map[int]bool{}
+
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		from, to := part, part
+		if d := strings.Index(part, "-"); d > 0 {
+			from, to = strings.TrimSpace(part[:d]), strings.TrimSpace(part[d+1:])
+		}
+
+		start, err := strconv.Atoi(from)
+		if err != nil {
+			return nil, fmt.Errorf("'%s' isn't a number or range", part)
+		}
+
+		end, err := strconv.Atoi(to)
+		if err != nil {
+			return nil, fmt.Errorf("'%s' isn't a number or range", part)
+		}
+
+		if start > end || start < 0 || end >= n {
+			return nil, fmt.Errorf("'%s' is out of range", part)
+		}
+
+		for i := start; i <= end; i++ {
+			seen[i] = true
+		}
+	}
+
+	if len(seen) == 0 {
+		return nil, errors.New("nothing was selected")
+	}
+
+	var selected []int
+	for i := range seen {
+		selected = append(selected, i)
+	}
+
+	sort.Ints(selected)
+	return selected, nil
+}
+
+func promptUserForText() (string, error) {
+	s, err := stdinReader.ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("reading the answer: %s", err)
+	}
+
+	s = strings.TrimRight(s, "\n")
+	s = strings.TrimRight(s, "\r")
+
+	return strings.TrimSpace(s), nil
+}
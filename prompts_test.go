@@ -0,0 +1,41 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSelection(t *testing.T) {
+	tests := []struct {
+		in      string
+		n       int
+		want    []int
+		wantErr bool
+	}{
+		{in: "0", n: 3, want: []int{0}},
+		{in: "2,0", n: 3, want: []int{0, 2}},
+		{in: "1,3,5-7", n: 8, want: []int{1, 3, 5, 6, 7}},
+		{in: " 1 - 3 , 2 ", n: 4, want: []int{1, 2, 3}},
+		{in: "1,,2,", n: 3, want: []int{1, 2}},
+		{in: "4-4", n: 5, want: []int{4}},
+		{in: "", n: 3, wantErr: true},
+		{in: " , ", n: 3, wantErr: true},
+		{in: "a", n: 3, wantErr: true},
+		{in: "1-b", n: 3, wantErr: true},
+		{in: "3", n: 3, wantErr: true},
+		{in: "2-1", n: 3, wantErr: true},
+		{in: "-1", n: 3, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseSelection(tt.in, tt.n)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseSelection(%q, %d) error = %v, want error %v", tt.in, tt.n, err, tt.wantErr)
+			continue
+		}
+
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseSelection(%q, %d) = %v, want %v", tt.in, tt.n, got, tt.want)
+		}
+	}
+}
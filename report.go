@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Formats the migration report can be written as
+const (
+	reportJSON = "json"
+	reportCSV  = "csv"
+	reportHTML = "html"
+)
+
+var reportFormats = []string{reportJSON, reportCSV, reportHTML, "No report"}
+
+// ReportRow is the migration result of a single trello card
+type ReportRow struct {
+	TrelloURL           string   `json:"trello_url"`
+	StoryID             int64    `json:"story_id"`
+	StoryURL            string   `json:"story_url"`
+	Status              string   `json:"status"`
+	Error               string   `json:"error"`
+	CommentsFound       int      `json:"comments_found"`
+	CommentsMigrated    int      `json:"comments_migrated"`
+	TasksFound          int      `json:"tasks_found"`
+	TasksMigrated       int      `json:"tasks_migrated"`
+	LabelsFound         int      `json:"labels_found"`
+	LabelsMigrated      int      `json:"labels_migrated"`
+	AttachmentsFound    int      `json:"attachments_found"`
+	AttachmentsMigrated int      `json:"attachments_migrated"`
+	UnmappedUsers       []string `json:"unmapped_users"`
+}
+
+var reportHeader = []string{
+	"Trello URL", "Story ID", "Story URL", "Status", "Error",
+	"Comments Found", "Comments Migrated", "Tasks Found", "Tasks Migrated",
+	"Labels Found", "Labels Migrated", "Attachments Found", "Attachments Migrated",
+	"Unmapped Users",
+}
+
+var reportHTMLTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Trello to Clubhouse migration report</title>
+<style>
+table { border-collapse: collapse; font-family: sans-serif; font-size: 13px; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; }
+.Failed { background: #fdd; }
+.Partial { background: #ffd; }
+</style>
+</head>
+<body>
+<h1>Trello to Clubhouse migration report</h1>
+<table>
+<tr>{{range .Header}}<th>{{.}}</th>{{end}}</tr>
+{{range .Rows}}<tr class="{{index . 3}}">{{range $i, $v := .}}{{if eq $i 0 2}}<td><a href="{{$v}}">{{$v}}</a></td>{{else}}<td>{{$v}}</td>{{end}}{{end}}</tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// newReportRow starts the report row for the card with the counts found in trello
+func newReportRow(card *Card, um *UserMap) ReportRow {
+	return ReportRow{
+		TrelloURL:        card.ShortURL,
+		CommentsFound:    len(card.Comments),
+		TasksFound:       len(card.Tasks),
+		LabelsFound:      len(card.Labels),
+		AttachmentsFound: card.AttachmentsFound,
+		UnmappedUsers:    um.UnmappedUsersForCard(card),
+	}
+}
+
+// addError records an error on the row, marking a created story as partial
+func (r *ReportRow) addError(err error) {
+	if r.Error != "" {
+		r.Error += "; "
+	}
+
+	r.Error += err.Error()
+
+	if r.Status == "Success" {
+		r.Status = "Partial"
+	}
+}
+
+func (r ReportRow) csvRecord() []string {
+	var storyID string
+	if r.StoryID != 0 {
+		storyID = strconv.FormatInt(r.StoryID, 10)
+	}
+
+	return []string{
+		r.TrelloURL, storyID, r.StoryURL, r.Status, r.Error,
+		strconv.Itoa(r.CommentsFound), strconv.Itoa(r.CommentsMigrated),
+		strconv.Itoa(r.TasksFound), strconv.Itoa(r.TasksMigrated),
+		strconv.Itoa(r.LabelsFound), strconv.Itoa(r.LabelsMigrated),
+		strconv.Itoa(r.AttachmentsFound), strconv.Itoa(r.AttachmentsMigrated),
+		strings.Join(r.UnmappedUsers, ", "),
+	}
+}
+
+func (co *ClubhouseOptions) promptUserForReportFormat() error {
+	i, err := ui.Select("Please select the format of the migration report written after the import", reportFormats)
+	if err != nil {
+		return err
+	}
+
+	if i < len(reportFormats)-1 {
+		co.ReportFormat = reportFormats[i]
+	}
+
+	return nil
+}
+
+// WriteMigrationReport writes the rows to a timestamped report file
+// in the current directory and returns the path of the file
+func WriteMigrationReport(rows []ReportRow, format string) (string, error) {
+	path := getWorkingDirFilePath(fmt.Sprintf("migrationReport-%s.%s", time.Now().Format("20060102-150405"), format))
+
+	f, err := os.Create(path)
+	if err != nil {
+		return "", fmt.Errorf("creating migration report file: %s", err)
+	}
+
+	defer f.Close()
+
+	switch format {
+	case reportJSON:
+		e := json.NewEncoder(f)
+		e.SetIndent("", "  ")
+		err = e.Encode(rows)
+	case reportCSV:
+		w := csv.NewWriter(f)
+		records := [][]string{reportHeader}
+		for _, r := range rows {
+			records = append(records, r.csvRecord())
+		}
+		err = w.WriteAll(records)
+	case reportHTML:
+		var records [][]string
+		for _, r := range rows {
+			records = append(records, r.csvRecord())
+		}
+		err = reportHTMLTemplate.Execute(f, map[string]interface{}{"Header": reportHeader, "Rows": records})
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("writing migration report file: %s", err)
+	}
+
+	return path, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	ch "github.com/jnormington/clubhouse-go"
+)
+
+// RunRollback deletes the stories, linked files and epics created by a run.
+// With -dry-run it only lists what would be deleted
+func RunRollback(args []string) error {
+	fs := newFlagSet("rollback", "<run-id>")
+	dryRun := fs.Bool("dry-run", false, "list what would be deleted without deleting")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+
+	rl, err := LoadRunLog(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Run %s started at %s created:\n", rl.RunID, rl.StartedAt.Format(timelineDateLayout))
+	fmt.Printf("\tStories: %v\n\tLinked Files: %v\n\tEpics: %v\n\n", rl.Stories, rl.LinkedFiles, rl.Epics)
+
+	if *dryRun {
+		return nil
+	}
+
+	yes, err := promptUserYesNo("****** WARNING ******\n" +
+		"Are you sure you want to delete all of the above from Clubhouse?")
+	if err != nil {
+		return err
+	}
+
+	if !yes {
+		return errAborted
+	}
+
+	c := ch.New(clubHouseToken)
+
+	for _, id := range rl.Stories {
+		printRollbackResult("Story", id, c.DeleteStory(id))
+	}
+
+	for _, id := range rl.LinkedFiles {
+		printRollbackResult("Linked File", id, c.DeleteLinkedFile(id))
+	}
+
+	for _, id := range rl.Epics {
+		printRollbackResult("Epic", id, c.DeleteEpic(id))
+	}
+
+	return nil
+}
+
+// printRollbackResult prints the result of a delete, recording a
+// failed delete in the failures so the command exits with an error
+func printRollbackResult(kind string, id int64, err error) {
+	if err != nil {
+		fmt.Printf(outputFormat, fmt.Sprintf("%s ID: %d", kind, id), "Failed", err)
+		failures.Add(stageRollback, fmt.Sprintf("%s ID: %d", kind, id), "", err)
+		return
+	}
+
+	fmt.Printf(outputFormat, fmt.Sprintf("%s ID: %d", kind, id), "Deleted", "")
+}
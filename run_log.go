@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	ch "github.com/jnormington/clubhouse-go"
+)
+
+const runIDLayout = "20060102-150405"
+
+// RunLog records everything created in clubhouse by a single run
+// so the run can be rolled back. Each change is appended to the
+// log file as a line of json and replayed when it's loaded
+type RunLog struct {
+	RunID       string    `json:"run_id"`
+	PlanID      string    `json:"plan_id"`
+	StartedAt   time.Time `json:"started_at"`
+	Stories     []int64   `json:"stories"`
+	LinkedFiles []int64   `json:"linked_files"`
+	Epics       []int64   `json:"epics"`
+
+	Imported []ImportedCard `json:"imported"`
+
+	// The options, user mapping and export rules of the run, kept
+	// so verify can map the trello cards the same way the run did
+	Options          *ClubhouseOptions `json:"options"`
+	Users            *UserMap          `json:"users"`
+	LabelRules       LabelRules        `json:"label_rules"`
+	EstimatePatterns []EstimatePattern `json:"estimate_patterns"`
+	ProcessImages    bool              `json:"process_images"`
+}
+
+// ImportedCard is a trello card and the story created in clubhouse for it
+type ImportedCard struct {
+	TrelloURL string `json:"trello_url"`
+	StoryID   int64  `json:"story_id"`
+	Name      string `json:"name"`
+	StateID   int64  `json:"state_id"`
+}
+
+// runLogRecord is a line of the run log, only the fields of its type are set
+type runLogRecord struct {
+	Type string `json:"type"`
+
+	RunID     string     `json:"run_id,omitempty"`
+	PlanID    string     `json:"plan_id,omitempty"`
+	StartedAt *time.Time `json:"started_at,omitempty"`
+
+	ID       int64         `json:"id,omitempty"`
+	Imported *ImportedCard `json:"imported,omitempty"`
+
+	Options          *ClubhouseOptions `json:"options,omitempty"`
+	Users            *UserMap          `json:"users,omitempty"`
+	LabelRules       LabelRules        `json:"label_rules,omitempty"`
+	EstimatePatterns []EstimatePattern `json:"estimate_patterns,omitempty"`
+	ProcessImages    bool              `json:"process_images,omitempty"`
+}
+
+// The types of the run log records
+const (
+	runLogStart      = "start"
+	runLogOptions    = "options"
+	runLogStory      = "story"
+	runLogImport     = "import"
+	runLogLinkedFile = "linked_file"
+	runLogEpic       = "epic"
+)
+
+// NewRunLog starts the log for a new run of the plan with an id from the current
+// time, a number is added to the id when a run started in the same second
+func NewRunLog(planID string) (*RunLog, error) {
+	now := time.Now()
+	id := now.Format(runIDLayout)
+
+	for n := 2; ; n++ {
+		f, err := os.OpenFile(getRunLogPath(id), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			f.Close()
+			break
+		}
+
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("creating the run log %s: %s", getRunLogPath(id), err)
+		}
+
+		id = fmt.Sprintf("%s-%d", now.Format(runIDLayout), n)
+	}
+
+	rl := RunLog{
+		RunID:     id,
+		PlanID:    planID,
+		StartedAt: now,
+	}
+
+	rl.append(runLogRecord{Type: runLogStart, RunID: rl.RunID, PlanID: rl.PlanID, StartedAt: &rl.StartedAt})
+	return &rl, nil
+}
+
+// LoadRunLog reads the log of a previous run by its id
+func LoadRunLog(runID string) (*RunLog, error) {
+	f, err := os.Open(getRunLogPath(runID))
+	if err != nil {
+		return nil, fmt.Errorf("reading the run log for %s: %s", runID, err)
+	}
+	defer f.Close()
+
+	rl := RunLog{RunID: runID}
+
+	dec := json.NewDecoder(f)
+	for {
+		var r runLogRecord
+		if err := dec.Decode(&r); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("parsing the run log for %s: %s", runID, err)
+		}
+
+		rl.replay(&r)
+	}
+
+	return &rl, nil
+}
+
+// replay applies a record read from the log file to the run log
+func (rl *RunLog) replay(r *runLogRecord) {
+	switch r.Type {
+	case runLogStart:
+		rl.PlanID = r.PlanID
+		if r.StartedAt != nil {
+			rl.StartedAt = *r.StartedAt
+		}
+	case runLogOptions:
+		rl.Options = r.Options
+		rl.Users = r.Users
+		rl.LabelRules = r.LabelRules
+		rl.EstimatePatterns = r.EstimatePatterns
+		rl.ProcessImages = r.ProcessImages
+	case runLogStory:
+		rl.Stories = append(rl.Stories, r.ID)
+	case runLogImport:
+		if r.Imported != nil {
+			rl.Stories = append(rl.Stories, r.Imported.StoryID)
+			rl.Imported = append(rl.Imported, *r.Imported)
+		}
+	case runLogLinkedFile:
+		rl.LinkedFiles = append(rl.LinkedFiles, r.ID)
+	case runLogEpic:
+		rl.Epics = append(rl.Epics, r.ID)
+	}
+}
+
+func getRunLogPath(runID string) string {
+	return getWorkingDirFilePath(fmt.Sprintf("migrationRun-%s.jsonl", runID))
+}
+
+// RecordStory adds a created story to the run log
+func (rl *RunLog) RecordStory(id int64) {
+	if rl == nil {
+		return
+	}
+
+	rl.record(runLogRecord{Type: runLogStory, ID: id})
+}
+
+// RecordImport adds the story created for a trello card to the run log
+func (rl *RunLog) RecordImport(trelloURL string, storyID int64, story *ch.CreateStory) {
+	if rl == nil {
+		return
+	}
+
+	ic := ImportedCard{TrelloURL: trelloURL, StoryID: storyID, Name: story.Name, StateID: story.WorkflowStateID}
+	rl.record(runLogRecord{Type: runLogImport, Imported: &ic})
+}
+
+// RecordOptions adds the options, user mapping and the rules
+// the cards were exported with to the run log
+func (rl *RunLog) RecordOptions(src *Export, co *ClubhouseOptions, um *UserMap) {
+	if rl == nil {
+		return
+	}
+
+	rl.record(runLogRecord{
+		Type:             runLogOptions,
+		Options:          co,
+		Users:            um,
+		LabelRules:       src.LabelRules,
+		EstimatePatterns: src.EstimatePatterns,
+		ProcessImages:    src.ProcessImages,
+	})
+}
+
+// RecordLinkedFile adds a created linked file to the run log
+func (rl *RunLog) RecordLinkedFile(id int64) {
+	if rl == nil {
+		return
+	}
+
+	rl.record(runLogRecord{Type: runLogLinkedFile, ID: id})
+}
+
+// FindImported returns the story already created by the run for the trello card
+func (rl *RunLog) FindImported(trelloURL string) *ImportedCard {
+	if rl == nil {
+		return nil
+	}
+
+	for i, ic := range rl.Imported {
+		if ic.TrelloURL == trelloURL {
+			return &rl.Imported[i]
+		}
+	}
+
+	return nil
+}
+
+// HasEpic returns whether the epic was created by the run
+func (rl *RunLog) HasEpic(id int64) bool {
+	if rl == nil {
+		return false
+	}
+
+	for _, e := range rl.Epics {
+		if e == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RecordEpic adds a created epic to the run log
+func (rl *RunLog) RecordEpic(id int64) {
+	if rl == nil {
+		return
+	}
+
+	rl.record(runLogRecord{Type: runLogEpic, ID: id})
+}
+
+// record applies the record to the run log and appends it to the log file
+func (rl *RunLog) record(r runLogRecord) {
+	rl.replay(&r)
+	rl.append(r)
+}
+
+// append writes the record as a line at the end of the log file. We don't stop
+// with resources already created, the failure is listed with the card errors
+// as the run can't be fully rolled back
+func (rl *RunLog) append(r runLogRecord) {
+	b, err := json.Marshal(r)
+	if err == nil {
+		var f *os.File
+		if f, err = os.OpenFile(getRunLogPath(rl.RunID), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644); err == nil {
+			_, err = f.Write(append(b, '\n'))
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+		}
+	}
+
+	if err != nil {
+		recordCardError(stageRunLog, r.Type, getRunLogPath(rl.RunID), fmt.Errorf("writing the run log: %s", err))
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+const trelloAPIURL = "https://api.trello.com/1"
+
+// getTrelloResource queries the Trello REST api directly for the resources
+// the trello package doesn't expose, decoding the json response into v.
+func getTrelloResource(path string, params url.Values, v interface{}) error {
+	if params == nil {
+		params = url.Values{}
+	}
+
+	params.Set("key", trelloKey)
+	params.Set("token", trelloToken)
+
+	resp, err := http.Get(fmt.Sprintf("%s%s?%s", trelloAPIURL, path, params.Encode()))
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("trello api returned %s for %s", resp.Status, path)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -1,9 +1,10 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-	"log"
-	"strconv"
+	"net/url"
+	"os"
 	"strings"
 
 	trello "github.com/jnormington/go-trello"
@@ -11,135 +12,462 @@ import (
 
 // TrelloOptions stores options that the user has selected
 type TrelloOptions struct {
-	Board         *trello.Board
-	List          *trello.List
-	User          *trello.Member
-	ProcessImages bool
+	Board              *trello.Board
+	Lists              []trello.List
+	EpicLists          []string
+	User               *trello.Member
+	ProcessImages      bool
+	AddTimelineComment bool
+	LabelRules         LabelRules
+	CardFilters        *CardFilters
+	IncludeArchived    bool
+	Client             *trello.Client
+	sel                *Selection
+	EstimatePatterns   []EstimatePattern
+	CustomFieldDefs    []trelloCustomFieldDef
 }
 
+const labelRulesFile = "labelRules.csv"
+const cardFiltersFile = "cardFilters.csv"
+
 // SetupTrelloOptionsFromUser calls all the functions which consist of questions
-// for building TrelloOptions and returns a pointer to TrelloOptions instance
-func SetupTrelloOptionsFromUser() *TrelloOptions {
+// for building TrelloOptions and returns a pointer to TrelloOptions instance.
+// The board and list are only asked for when not already given in the selection
+func SetupTrelloOptionsFromUser(sel *Selection) (*TrelloOptions, error) {
 	var t TrelloOptions
 
-	t.promptUserShouldMigrateAttachments()
-	t.getCurrentUser()
-	t.getBoardsAndPromptUser()
-	t.getListsAndPromptUser()
-
-	return &t
-}
+	t.sel = sel
 
-func (t *TrelloOptions) promptUserShouldMigrateAttachments() {
-	fmt.Println("Would you like to migrate all attachments from trello cards?")
-	fmt.Println("This will entail downloading the attachments and uploading to dropbox")
-	fmt.Println("A dropbox account will be required for the token")
+	steps := []func() error{
+		t.promptUserShouldMigrateAttachments,
+		t.promptUserShouldAddTimelineComment,
+		t.promptUserShouldApplyLabelRules,
+		t.promptUserShouldParseEstimates,
+		t.getCurrentUser,
+		t.getBoardsAndPromptUser,
+		t.promptUserShouldIncludeArchived,
+		t.getListsAndPromptUser,
+		t.promptUserShouldMigrateCustomFields,
+		t.promptUserShouldFilterCards,
+	}
 
-	for i, b := range yesNoOpts {
-		fmt.Printf("[%d] %s\n", i, b)
+	for _, step := range steps {
+		if err := step(); err != nil {
+			return nil, err
+		}
 	}
 
-	i := promptUserSelectResource()
-	if i >= len(yesNoOpts) {
-		log.Fatal(errOutOfRange)
+	return &t, nil
+}
+
+func (t *TrelloOptions) promptUserShouldMigrateAttachments() error {
+	yes, err := promptUserYesNo("Would you like to migrate all attachments from trello cards?\n" +
+		"This will entail downloading the attachments and uploading to dropbox\n" +
+		"A dropbox account will be required for the token")
+	if err != nil {
+		return err
 	}
 
-	if i == 0 {
+	if yes {
 		t.ProcessImages = true
 		if dropboxToken == "" {
-			log.Fatal("Dropbox token not supplied unable to continue")
+			return errors.New("dropbox token not supplied unable to continue")
+		}
+	}
+
+	return nil
+}
+
+func (t *TrelloOptions) promptUserShouldAddTimelineComment() error {
+	yes, err := promptUserYesNo("Would you like a comment added with the card timeline?\n" +
+		"This lists every list move, member change and due date change of the card")
+	if err != nil {
+		return err
+	}
+
+	if yes {
+		t.AddTimelineComment = true
+	}
+
+	return nil
+}
+
+func (t *TrelloOptions) promptUserShouldApplyLabelRules() error {
+	yes, err := promptUserYesNo("Would you like to rename, merge, drop or add labels with a label rules CSV?\n" +
+		"CSV file: " + getWorkingDirFilePath(labelRulesFile))
+	if err != nil {
+		return err
+	}
+
+	if yes {
+		t.LabelRules, err = LoadLabelRulesFromCSV(getWorkingDirFilePath(labelRulesFile))
+	}
+
+	return err
+}
+
+func (t *TrelloOptions) promptUserShouldParseEstimates() error {
+	yes, err := promptUserYesNo("Would you like story estimates parsed from card names like '(3) Fix login'?\n" +
+		"Custom patterns are read from: " + getWorkingDirFilePath(estimatePatternsFile))
+	if err != nil {
+		return err
+	}
+
+	if yes {
+		t.EstimatePatterns, err = LoadEstimatePatterns(getWorkingDirFilePath(estimatePatternsFile))
+	}
+
+	return err
+}
+
+func (t *TrelloOptions) promptUserShouldMigrateCustomFields() error {
+	defs, err := getCustomFieldDefsForBoard(t.Board.Id)
+	if err != nil || len(defs) == 0 {
+		return err
+	}
+
+	yes, err := promptUserYesNo("Would you like to migrate the trello custom fields?")
+	if err != nil {
+		return err
+	}
+
+	if yes {
+		t.CustomFieldDefs = defs
+	}
+
+	return nil
+}
+
+func (t *TrelloOptions) promptUserShouldFilterCards() error {
+	yes, err := promptUserYesNo("Would you like to only migrate the cards matching a card filters CSV?\n" +
+		"CSV file: " + getWorkingDirFilePath(cardFiltersFile))
+	if err != nil || !yes {
+		return err
+	}
+
+	members, err := t.ListMembers()
+	if err != nil {
+		return err
+	}
+
+	t.CardFilters, err = LoadCardFiltersFromCSV(getWorkingDirFilePath(cardFiltersFile), members)
+	return err
+}
+
+// ListName returns the name of the selected list by its id
+func (t TrelloOptions) ListName(id string) string {
+	for _, l := range t.Lists {
+		if l.Id == id {
+			return l.Name
 		}
 	}
+
+	return ""
 }
 
-func (t *TrelloOptions) getCurrentUser() {
+func (t *TrelloOptions) getCurrentUser() error {
 	c, err := trello.NewAuthClient(trelloKey, &trelloToken)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	u, err := c.Member("me")
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("querying the trello user: %s", err)
 	}
 
+	t.Client = c
 	t.User = u
+
+	return nil
 }
 
-func (t *TrelloOptions) getBoardsAndPromptUser() {
+func (t *TrelloOptions) promptUserShouldIncludeArchived() error {
+	yes, err := promptUserYesNo("Would you like to also migrate archived cards and archived lists?")
+	if err != nil {
+		return err
+	}
+
+	if yes {
+		t.IncludeArchived = true
+	}
+
+	return nil
+}
+
+// getArchivedLists returns the archived lists on the board, the trello
+// package only returns open lists so we look up the ids and fetch each one
+func (t *TrelloOptions) getArchivedLists() ([]trello.List, error) {
+	var ids []struct {
+		ID       string `json:"id"`
+		Name     string `json:"name"`
+		ShortURL string `json:"shortUrl"`
+	}
+
+	params := url.Values{}
+	params.Set("filter", "closed")
+	params.Set("fields", "id,name,shortUrl")
+
+	err := getTrelloResource("/boards/"+t.Board.Id+"/lists", params, &ids)
+	if err != nil {
+		return nil, fmt.Errorf("querying the archived lists: %s", err)
+	}
+
+	var lists []trello.List
+	for _, id := range ids {
+		l, err := t.Client.List(id.ID)
+		if err != nil {
+			return nil, fmt.Errorf("querying the archived list %s: %s", id.ID, err)
+		}
+
+		lists = append(lists, *l)
+	}
+
+	return lists, nil
+}
+
+// getArchivedCards returns the archived cards in the list, the trello
+// package only returns open cards so we look up the ids and fetch each one
+func (t *TrelloOptions) getArchivedCards(list *trello.List) ([]trello.Card, error) {
+	var ids []struct {
+		ID       string `json:"id"`
+		Name     string `json:"name"`
+		ShortURL string `json:"shortUrl"`
+	}
+
+	params := url.Values{}
+	params.Set("filter", "closed")
+	params.Set("fields", "id,name,shortUrl")
+
+	err := getTrelloResource("/lists/"+list.Id+"/cards", params, &ids)
+	if err != nil {
+		return nil, fmt.Errorf("querying the archived cards of %s: %s", list.Name, err)
+	}
+
+	var cards []trello.Card
+	for _, id := range ids {
+		c, err := t.Client.Card(id.ID)
+		if err != nil {
+			recordCardError(stageExport, id.Name, id.ShortURL, fmt.Errorf("querying the archived card: %s", err))
+			continue
+		}
+
+		cards = append(cards, *c)
+	}
+
+	return cards, nil
+}
+
+// ListPosition returns the position of the selected list with the id
+func (t TrelloOptions) ListPosition(id string) float32 {
+	for _, l := range t.Lists {
+		if l.Id == id {
+			return l.Pos
+		}
+	}
+
+	return 0
+}
+
+// IsListArchived returns whether the selected list with the id is archived
+func (t TrelloOptions) IsListArchived(id string) bool {
+	for _, l := range t.Lists {
+		if l.Id == id {
+			return l.Closed
+		}
+	}
+
+	return false
+}
+
+func (t *TrelloOptions) getBoardsAndPromptUser() error {
 	boards, err := t.User.Boards()
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("querying the trello boards: %s", err)
 	}
 
-	fmt.Println("Please select a board by its number")
-	for i, b := range boards {
-		fmt.Printf("[%d] %s\n", i, b.Name)
+	if t.sel.Board != "" {
+		for i, b := range boards {
+			if b.Id == t.sel.Board || strings.EqualFold(b.Name, t.sel.Board) {
+				t.Board = &boards[i]
+				return nil
+			}
+		}
+
+		return fmt.Errorf("board '%s' not found", t.sel.Board)
 	}
 
-	i := promptUserSelectResource()
-	if i >= len(boards) {
-		log.Fatal(errOutOfRange)
+	var names []string
+	for _, b := range boards {
+		names = append(names, b.Name)
+	}
+
+	i, err := ui.Select("Please select a board by its number, or type part of its name to search", names)
+	if err != nil {
+		return err
 	}
 
 	t.Board = &boards[i]
+
+	return nil
 }
 
-func (t *TrelloOptions) getListsAndPromptUser() {
+func (t *TrelloOptions) getListsAndPromptUser() error {
 	lists, err := t.Board.Lists()
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("querying the lists of %s: %s", t.Board.Name, err)
 	}
 
-	fmt.Println("Please select the list to import by number")
-	for i, l := range lists {
-		fmt.Printf("[%d] %s\n", i, l.Name)
+	if t.IncludeArchived {
+		archived, err := t.getArchivedLists()
+		if err != nil {
+			return err
+		}
+
+		lists = append(lists, archived...)
 	}
 
-	i := promptUserSelectResource()
-	if i >= len(lists) {
-		log.Fatal(errOutOfRange)
+	if t.sel.AllLists {
+		t.Lists = lists
+		for _, l := range lists {
+			t.EpicLists = append(t.EpicLists, l.Id)
+		}
+		return nil
 	}
 
-	t.List = &lists[i]
-}
+	if t.sel.List != "" {
+		for _, l := range lists {
+			if l.Id == t.sel.List || strings.EqualFold(l.Name, t.sel.List) {
+				t.Lists = []trello.List{l}
+				return nil
+			}
+		}
 
-func (t TrelloOptions) getCards() []trello.Card {
-	fmt.Println("Please wait while we retrieve your cards... This might take a few minutes.")
+		return fmt.Errorf("list '%s' not found on the board '%s'", t.sel.List, t.Board.Name)
+	}
 
-	cards, err := t.List.Cards()
+	var names []string
+	for _, l := range lists {
+		if l.Closed {
+			names = append(names, l.Name+" (archived)")
+		} else {
+			names = append(names, l.Name)
+		}
+	}
+	names = append(names, "All lists on the board")
+
+	selected, err := ui.SelectMany("Please select the lists to import by number", names)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	return cards
+	t.Lists = nil
+	for _, i := range selected {
+		if i == len(lists) {
+			t.Lists = lists
+			break
+		}
+
+		t.Lists = append(t.Lists, lists[i])
+	}
+
+	if len(t.Lists) > 1 {
+		return t.promptUserForEpicLists()
+	}
+
+	return nil
 }
 
-func promptUserSelectResource() int {
-	i, err := stdinReader.ReadString('\n')
-	if err != nil {
-		log.Fatal(err)
+// promptUserForEpicLists asks which of the selected lists become
+// epics, the cards of the other lists are imported without an epic
+func (t *TrelloOptions) promptUserForEpicLists() error {
+	var names []string
+	for _, l := range t.Lists {
+		names = append(names, l.Name)
 	}
+	names = append(names, "None of the lists")
 
-	i = strings.TrimRight(i, "\n")
-	i = strings.TrimRight(i, "\r")
-	id, err := strconv.Atoi(i)
+	selected, err := ui.SelectMany("Please select the lists which become epics by number", names)
 	if err != nil {
-		log.Fatal("Hmm... did you type a number from the list ?")
+		return err
+	}
+
+	t.EpicLists = nil
+	for _, i := range selected {
+		if i == len(t.Lists) {
+			t.EpicLists = nil
+			break
+		}
+
+		t.EpicLists = append(t.EpicLists, t.Lists[i].Id)
 	}
 
-	return id
+	return nil
 }
 
-// ListMembers gets the members for the selected board.
-// And fails hard if an err occurs.
-func (t TrelloOptions) ListMembers() *[]trello.Member {
-	m, err := t.Board.Members()
+// ListNames returns the names of the selected lists for display
+func (t TrelloOptions) ListNames() string {
+	var names []string
+
+	for _, l := range t.Lists {
+		names = append(names, l.Name)
+	}
+
+	return strings.Join(names, ", ")
+}
+
+// EpicListNames returns the names of the lists which become epics for display
+func (t TrelloOptions) EpicListNames() string {
+	var names []string
+
+	for _, id := range t.EpicLists {
+		names = append(names, t.ListName(id))
+	}
+
+	if len(names) == 0 {
+		return "none"
+	}
+
+	return strings.Join(names, ", ")
+}
+
+func (t TrelloOptions) getCards() ([]trello.Card, error) {
+	fmt.Println("Please wait while we retrieve your cards... This might take a few minutes.")
+
+	var cards []trello.Card
+
+	for _, l := range t.Lists {
+		c, err := l.Cards()
+		if err != nil {
+			return nil, fmt.Errorf("querying the cards of %s: %s", l.Name, err)
+		}
+
+		cards = append(cards, c...)
 
+		if t.IncludeArchived {
+			archived, err := t.getArchivedCards(&l)
+			if err != nil {
+				return nil, err
+			}
+
+			cards = append(cards, archived...)
+		}
+	}
+
+	if t.CardFilters != nil {
+		cards = t.CardFilters.Apply(cards)
+		t.CardFilters.WriteSummary(os.Stdout)
+	}
+
+	return cards, nil
+}
+
+// ListMembers gets the members for the selected board
+func (t TrelloOptions) ListMembers() (*[]trello.Member, error) {
+	m, err := t.Board.Members()
 	if err != nil {
-		fmt.Println("Error retrieving board members")
-		log.Fatal(err)
+		return nil, fmt.Errorf("retrieving board members: %s", err)
 	}
 
-	return &m
+	return &m, nil
 }
@@ -0,0 +1,616 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+	ch "github.com/jnormington/clubhouse-go"
+	"github.com/rivo/tview"
+)
+
+// tuiAnswer is the answer given on a question page
+type tuiAnswer struct {
+	Selected []int
+	Text     string
+}
+
+// tui asks the questions with navigable lists and tables in the full
+// screen interface, then shows the progress of the import card by card.
+// Everything printed while it runs is shown in the output pane
+type tui struct {
+	app    *tview.Application
+	pages  *tview.Pages
+	wait   *tview.TextView
+	output *tview.TextView
+
+	answers chan tuiAnswer
+	aborted chan struct{}
+	abort   sync.Once
+
+	// Only used in the event loop
+	progress    *tuiProgress
+	interrupted bool
+	finished    bool
+}
+
+// tuiProgress is the status of each card of the import
+type tuiProgress struct {
+	stats   *tview.TextView
+	table   *tview.Table
+	status  string
+	total   int
+	started time.Time
+
+	cards    []tuiCard
+	rows     map[string]int
+	imported int
+	failed   int
+	skipped  int
+}
+
+// tuiCard is a row of the progress table
+type tuiCard struct {
+	Name   string
+	Errors []string
+}
+
+// runWithTUI runs fn with its questions and progress in the full screen
+// interface, once it's closed everything fn printed is printed again
+func runWithTUI(fn func() error) error {
+	t := newTUI()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("capturing the output: %s", err)
+	}
+
+	var printed bytes.Buffer
+	copied := make(chan struct{})
+
+	go func() {
+		io.Copy(io.MultiWriter(t.output, &printed), r)
+		close(copied)
+	}()
+
+	stdout, stderr := os.Stdout, os.Stderr
+	os.Stdout, os.Stderr = w, w
+	ui = t
+
+	var restoreOnce sync.Once
+	restore := func() {
+		restoreOnce.Do(func() {
+			ui = lineInterface{}
+			os.Stdout, os.Stderr = stdout, stderr
+			w.Close()
+			<-copied
+
+			os.Stdout.Write(printed.Bytes())
+		})
+	}
+
+	// A second Ctrl-C exits without returning here so restore the output first
+	stopped := make(chan struct{})
+	beforeExitAborted = func() {
+		t.app.Stop()
+		<-stopped
+		restore()
+	}
+	defer func() { beforeExitAborted = func() {} }()
+
+	done := make(chan error, 1)
+	go func() {
+		err := fn()
+		t.finish(err)
+		done <- err
+	}()
+
+	runErr := t.app.Run()
+	close(stopped)
+	if runErr != nil {
+		t.abort.Do(func() { close(t.aborted) })
+	}
+
+	err = <-done
+	restore()
+
+	if runErr != nil {
+		return fmt.Errorf("starting the full screen interface, use -line instead: %s", runErr)
+	}
+
+	return err
+}
+
+func newTUI() *tui {
+	t := &tui{
+		app:     tview.NewApplication(),
+		pages:   tview.NewPages(),
+		wait:    tview.NewTextView(),
+		output:  tview.NewTextView(),
+		answers: make(chan tuiAnswer, 1),
+		aborted: make(chan struct{}),
+	}
+
+	t.wait.SetText("Please wait...")
+	t.pages.AddPage("wait", t.wait, true, true)
+
+	t.output.SetScrollable(true)
+	t.output.ScrollToEnd()
+	t.output.SetChangedFunc(func() {
+		t.app.Draw()
+	})
+	t.output.SetBorder(true)
+	t.output.SetTitle(" Output ")
+
+	root := tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(t.pages, 0, 3, true).
+		AddItem(t.output, 0, 2, false)
+
+	t.app.SetRoot(root, true)
+	t.app.SetInputCapture(t.captureKey)
+
+	return t
+}
+
+// captureKey handles Ctrl-C which the terminal sends as a key press rather
+// than a signal while the full screen interface runs, and q once finished
+func (t *tui) captureKey(ev *tcell.EventKey) *tcell.EventKey {
+	if t.finished && ev.Key() == tcell.KeyRune && ev.Rune() == 'q' {
+		t.app.Stop()
+		return nil
+	}
+
+	if ev.Key() != tcell.KeyCtrlC {
+		return ev
+	}
+
+	switch {
+	case t.finished:
+		t.app.Stop()
+	case t.progress == nil:
+		// Still asking the questions so nothing is migrated yet
+		t.abort.Do(func() { close(t.aborted) })
+	case !t.interrupted:
+		t.interrupted = true
+		t.progress.status = "Stopping after the current card... press Ctrl-C again to stop now"
+		t.progress.update()
+		requestInterrupt()
+	default:
+		// Restore the terminal as the run exits straight away
+		t.app.Stop()
+		requestInterrupt()
+	}
+
+	return nil
+}
+
+// ask shows the page of a question and waits for it to be answered
+func (t *tui) ask(page, focus tview.Primitive) (tuiAnswer, error) {
+	t.app.QueueUpdateDraw(func() {
+		t.pages.AddPage("question", page, true, true)
+		t.pages.SwitchToPage("question")
+		t.app.SetFocus(focus)
+	})
+
+	select {
+	case a := <-t.answers:
+		return a, nil
+	case <-t.aborted:
+		return tuiAnswer{}, errAborted
+	}
+}
+
+// answer hands the answer to the question being asked
+func (t *tui) answer(a tuiAnswer) {
+	t.pages.SwitchToPage("wait")
+	t.app.SetFocus(t.wait)
+
+	select {
+	case t.answers <- a:
+	default:
+	}
+}
+
+func (t *tui) Select(question string, options []string) (int, error) {
+	a, err := t.ask(t.listPage(question, options, false))
+	if err != nil {
+		return 0, err
+	}
+
+	return a.Selected[0], nil
+}
+
+func (t *tui) SelectMany(question string, options []string) ([]int, error) {
+	a, err := t.ask(t.listPage(question, options, true))
+	if err != nil {
+		return nil, err
+	}
+
+	return a.Selected, nil
+}
+
+func (t *tui) Text(question string) (string, error) {
+	input := tview.NewInputField().SetLabel("Answer: ")
+	input.SetDoneFunc(func(key tcell.Key) {
+		if key == tcell.KeyEnter {
+			t.answer(tuiAnswer{Text: strings.TrimSpace(input.GetText())})
+		}
+	})
+
+	a, err := t.ask(questionPage(question, input, "Enter to answer"), input)
+	if err != nil {
+		return "", err
+	}
+
+	return a.Text, nil
+}
+
+// listPage is a question answered by picking one of the options. Typing
+// searches the options and with many, space marks each option wanted
+func (t *tui) listPage(question string, options []string, many bool) (page, focus tview.Primitive) {
+	list := tview.NewList().ShowSecondaryText(false)
+	search := tview.NewInputField().SetLabel("Search: ")
+
+	marked := map[int]bool{}
+	var shown []int
+
+	label := func(i int) string {
+		switch {
+		case !many:
+			return tview.Escape(options[i])
+		case marked[i]:
+			return tview.Escape("[x] " + options[i])
+		default:
+			return tview.Escape("[ ] " + options[i])
+		}
+	}
+
+	fill := func(text string) {
+		list.Clear()
+		shown = nil
+
+		for i, o := range options {
+			if strings.Contains(strings.ToLower(o), strings.ToLower(text)) {
+				shown = append(shown, i)
+				list.AddItem(label(i), "", 0, nil)
+			}
+		}
+	}
+
+	search.SetChangedFunc(fill)
+	search.SetInputCapture(func(ev *tcell.EventKey) *tcell.EventKey {
+		switch ev.Key() {
+		case tcell.KeyUp, tcell.KeyDown, tcell.KeyPgUp, tcell.KeyPgDn:
+			// The search keeps the focus so it moves through the list
+			list.InputHandler()(ev, func(tview.Primitive) {})
+			return nil
+		case tcell.KeyRune:
+			if many && ev.Rune() == ' ' && len(shown) > 0 {
+				cur := list.GetCurrentItem()
+				marked[shown[cur]] = !marked[shown[cur]]
+				list.SetItemText(cur, label(shown[cur]), "")
+				return nil
+			}
+		}
+
+		return ev
+	})
+
+	search.SetDoneFunc(func(key tcell.Key) {
+		if key == tcell.KeyEscape {
+			search.SetText("")
+			return
+		}
+
+		if key != tcell.KeyEnter || len(shown) == 0 {
+			return
+		}
+
+		var selected []int
+		for i, m := range marked {
+			if m {
+				selected = append(selected, i)
+			}
+		}
+
+		if len(selected) == 0 {
+			selected = []int{shown[list.GetCurrentItem()]}
+		}
+
+		sort.Ints(selected)
+		t.answer(tuiAnswer{Selected: selected})
+	})
+
+	fill("")
+
+	hint := "Up/Down to move, type to search, Esc to clear the search, Enter to select"
+	if many {
+		hint = "Up/Down to move, type to search, Space to mark each one wanted, Enter to select"
+	}
+
+	answer := tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(list, 0, 1, false).
+		AddItem(search, 1, 0, true)
+
+	return questionPage(question, answer, hint), search
+}
+
+// questionPage lays out the question above the widget answering it
+func questionPage(question string, answer tview.Primitive, hint string) tview.Primitive {
+	text := tview.NewTextView().SetText(question).SetWordWrap(true)
+	keys := tview.NewTextView().SetText(hint + ", Ctrl-C to quit")
+
+	return tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(text, strings.Count(question, "\n")+2, 0, false).
+		AddItem(answer, 0, 1, true).
+		AddItem(keys, 1, 0, false)
+}
+
+// MapUsers shows the clubhouse user each trello member is mapped to, starting
+// from the user mapping csv when there is one or the best guess otherwise.
+// Each can be changed in place and the mapping is saved to the csv after
+func (t *tui) MapUsers(um *UserMap) error {
+	if _, err := os.Stat(getCSVPath()); err == nil {
+		if err := um.buildUserMapFromCSV(); err != nil {
+			return err
+		}
+	} else {
+		for _, m := range *um.TrelloMembers {
+			if u := um.guessClubhouseMember(m); u != nil {
+				um.Mapping[m.Id] = u.ID
+			}
+		}
+	}
+
+	users := []string{"Not mapped, use the backup user"}
+	for _, u := range *um.ClubhouseMembers {
+		users = append(users, clubhouseMemberText(u))
+	}
+
+	var row int
+	for {
+		a, err := t.ask(t.userMappingPage(um, row))
+		if err != nil {
+			return err
+		}
+
+		row = a.Selected[0]
+		if row >= len(*um.TrelloMembers) {
+			break
+		}
+
+		m := (*um.TrelloMembers)[row]
+		question := fmt.Sprintf("Please select the clubhouse user for the trello member %s (@%s), or type part of a name to search", m.FullName, m.Username)
+
+		i, err := t.Select(question, users)
+		if err != nil {
+			return err
+		}
+
+		delete(um.Mapping, m.Id)
+		delete(um.Fallbacks, m.Id)
+		if i > 0 {
+			um.Mapping[m.Id] = (*um.ClubhouseMembers)[i-1].ID
+		}
+	}
+
+	if err := um.writeMappingCSV(); err != nil {
+		return err
+	}
+
+	fmt.Printf("User mapping saved to: %s\n", getCSVPath())
+	return nil
+}
+
+// userMappingPage is a table of the trello members and the clubhouse users
+// they're mapped to, selecting a member answers with its number
+func (t *tui) userMappingPage(um *UserMap, selected int) (page, focus tview.Primitive) {
+	table := tview.NewTable().SetSelectable(true, false).SetFixed(1, 0)
+
+	table.SetCell(0, 0, tview.NewTableCell("Trello member").SetSelectable(false).SetTextColor(tcell.ColorYellow))
+	table.SetCell(0, 1, tview.NewTableCell("Clubhouse user").SetSelectable(false).SetTextColor(tcell.ColorYellow))
+
+	for i, m := range *um.TrelloMembers {
+		user := "Not mapped, the backup user"
+		for _, u := range *um.ClubhouseMembers {
+			if u.ID == um.Mapping[m.Id] {
+				user = clubhouseMemberText(u)
+			}
+		}
+
+		member := fmt.Sprintf("%s (@%s)", m.FullName, m.Username)
+		table.SetCell(i+1, 0, tview.NewTableCell(tview.Escape(member)).SetExpansion(1))
+		table.SetCell(i+1, 1, tview.NewTableCell(tview.Escape(user)).SetExpansion(1))
+	}
+
+	table.SetCell(len(*um.TrelloMembers)+1, 0, tview.NewTableCell("Finished mapping users"))
+	table.Select(selected+1, 0)
+	table.SetSelectedFunc(func(row, _ int) {
+		t.answer(tuiAnswer{Selected: []int{row - 1}})
+	})
+
+	question := "Please select a trello member to change the clubhouse user it's mapped to, then 'Finished mapping users'\n" +
+		"The mapping is saved to: " + getCSVPath()
+
+	return questionPage(question, table, "Up/Down to move, Enter to change the user"), table
+}
+
+func clubhouseMemberText(u ch.Member) string {
+	if u.Profile.EmailAddress == "" {
+		return u.Profile.Name
+	}
+
+	return fmt.Sprintf("%s <%s>", u.Profile.Name, u.Profile.EmailAddress)
+}
+
+func (t *tui) StartProgress(total int) {
+	select {
+	case <-t.aborted:
+		// Ctrl-C was pressed after the last question
+		requestInterrupt()
+	default:
+	}
+
+	p := &tuiProgress{
+		stats:   tview.NewTextView(),
+		table:   tview.NewTable().SetSelectable(true, false).SetFixed(1, 0),
+		status:  "Press Ctrl-C to stop after the current card",
+		total:   total,
+		started: time.Now(),
+		rows:    map[string]int{},
+	}
+
+	for i, h := range []string{"Trello card", "Status", "Story ID"} {
+		p.table.SetCell(0, i, tview.NewTableCell(h).SetSelectable(false).SetTextColor(tcell.ColorYellow))
+	}
+
+	p.table.SetSelectedFunc(func(row, _ int) {
+		t.showCardErrors(row)
+	})
+
+	keys := tview.NewTextView().SetText("Up/Down to move, Enter to see the errors of a card")
+	page := tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(p.stats, 3, 0, false).
+		AddItem(p.table, 0, 1, true).
+		AddItem(keys, 1, 0, false)
+
+	t.app.QueueUpdateDraw(func() {
+		t.progress = p
+		p.update()
+
+		t.pages.AddPage("progress", page, true, true)
+		t.pages.SwitchToPage("progress")
+		t.app.SetFocus(p.table)
+	})
+}
+
+func (t *tui) CardStarted(name, url string) {
+	t.app.QueueUpdateDraw(func() {
+		p := t.progress
+
+		p.cards = append(p.cards, tuiCard{Name: name})
+		row := len(p.cards)
+		p.rows[url] = row
+
+		p.table.SetCell(row, 0, tview.NewTableCell(tview.Escape(name)).SetExpansion(1))
+		p.table.SetCell(row, 1, tview.NewTableCell("Importing"))
+		p.table.SetCell(row, 2, tview.NewTableCell(""))
+
+		// Follow the newest card unless another one is selected
+		if selected, _ := p.table.GetSelection(); selected >= row-1 {
+			p.table.Select(row, 0)
+		}
+	})
+}
+
+func (t *tui) CardImported(name string, row ReportRow) {
+	var errs []string
+	for _, e := range failures.ForURL(row.TrelloURL) {
+		errs = append(errs, fmt.Sprintf("%s: %s", e.Stage, e.Err))
+	}
+
+	if len(errs) == 0 && row.Error != "" {
+		errs = append(errs, row.Error)
+	}
+
+	t.app.QueueUpdateDraw(func() {
+		p := t.progress
+		r, ok := p.rows[row.TrelloURL]
+		if !ok {
+			return
+		}
+
+		p.cards[r-1].Errors = errs
+
+		status, color := row.Status, tcell.ColorGreen
+		switch {
+		case row.Status == "Skipped":
+			p.skipped++
+			color = tcell.ColorYellow
+		case row.Status == "Failed":
+			p.failed++
+			color = tcell.ColorRed
+		case len(errs) > 0:
+			p.imported++
+			status, color = "Success with errors", tcell.ColorYellow
+		default:
+			p.imported++
+		}
+
+		var story string
+		if row.StoryID != 0 {
+			story = fmt.Sprintf("%d", row.StoryID)
+		}
+
+		p.table.SetCell(r, 1, tview.NewTableCell(status).SetTextColor(color))
+		p.table.SetCell(r, 2, tview.NewTableCell(story))
+		p.update()
+	})
+}
+
+// showCardErrors shows the errors of the card in the row of the progress table
+func (t *tui) showCardErrors(row int) {
+	p := t.progress
+	if row < 1 || row > len(p.cards) {
+		return
+	}
+
+	c := p.cards[row-1]
+
+	text := "No errors for this card"
+	if len(c.Errors) > 0 {
+		text = strings.Join(c.Errors, "\n")
+	}
+
+	view := tview.NewTextView().SetText(c.Name + "\n\n" + text + "\n\nPress Enter or Esc to go back").SetWordWrap(true)
+	view.SetBorder(true)
+	view.SetTitle(" Card errors ")
+	view.SetDoneFunc(func(tcell.Key) {
+		t.pages.SwitchToPage("progress")
+		t.app.SetFocus(p.table)
+	})
+
+	t.pages.AddPage("errors", view, true, true)
+	t.pages.SwitchToPage("errors")
+	t.app.SetFocus(view)
+}
+
+// update shows the counts and throughput of the import so far
+func (p *tuiProgress) update() {
+	elapsed := time.Since(p.started)
+
+	var rate float64
+	if m := elapsed.Minutes(); m > 0 {
+		rate = float64(p.imported+p.failed) / m
+	}
+
+	p.stats.SetText(fmt.Sprintf("%d of %d cards done: %d imported, %d failed, %d skipped\n%.1f cards a minute, %s elapsed\n%s",
+		p.imported+p.failed+p.skipped, p.total, p.imported, p.failed, p.skipped,
+		rate, elapsed.Round(time.Second), p.status))
+}
+
+// finish closes the interface straight away when the run stopped before the
+// import started, otherwise the cards can be looked through until q is pressed
+func (t *tui) finish(err error) {
+	t.app.QueueUpdateDraw(func() {
+		t.finished = true
+
+		if t.progress == nil {
+			t.app.Stop()
+			return
+		}
+
+		t.progress.status = "Finished, press q to close and see the output"
+		if err != nil {
+			t.progress.status = fmt.Sprintf("Stopped: %s, press q to close and see the output", err)
+		}
+
+		t.progress.update()
+	})
+}
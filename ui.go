@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// userInterface asks the questions and shows the import progress, either
+// line by line or in the full screen interface
+type userInterface interface {
+	// Select returns the number of the option chosen for the question
+	Select(question string, options []string) (int, error)
+
+	// SelectMany returns the numbers of the options chosen for the question
+	SelectMany(question string, options []string) ([]int, error)
+
+	// Text returns the answer typed for the question
+	Text(question string) (string, error)
+
+	// MapUsers fills in the mapping of the trello members to clubhouse users
+	MapUsers(um *UserMap) error
+
+	// StartProgress is called before the import of the total cards starts
+	StartProgress(total int)
+
+	// CardStarted is called when the import of a card starts
+	CardStarted(name, url string)
+
+	// CardImported is called with the result of a card once it's imported
+	CardImported(name string, row ReportRow)
+}
+
+// ui is the interface the questions are asked through
+var ui userInterface = lineInterface{}
+
+// lineInterface asks the questions one line at a time on the terminal
+// and prints the result of each card as it's imported
+type lineInterface struct{}
+
+func (lineInterface) Select(question string, options []string) (int, error) {
+	fmt.Println(question)
+	return promptUserSelectFromList(options)
+}
+
+func (lineInterface) SelectMany(question string, options []string) ([]int, error) {
+	fmt.Println(question)
+	return promptUserSelectManyFromList(options)
+}
+
+func (lineInterface) Text(question string) (string, error) {
+	fmt.Println(question)
+	return promptUserForText()
+}
+
+// MapUsers generates the user mapping csv to be edited and then reads it
+func (lineInterface) MapUsers(um *UserMap) error {
+	return um.SetupUserMapping()
+}
+
+func (lineInterface) StartProgress(total int) {}
+
+func (lineInterface) CardStarted(name, url string) {}
+
+func (lineInterface) CardImported(name string, row ReportRow) {}
+
+// promptUserYesNo returns whether yes is the answer to the question
+func promptUserYesNo(question string) (bool, error) {
+	i, err := ui.Select(question, yesNoOpts)
+	return i == 0, err
+}
+
+// promptUserForNumber asks the question until a number is typed
+func promptUserForNumber(question string) (int, error) {
+	ask := question
+
+	for {
+		s, err := ui.Text(ask)
+		if err != nil {
+			return 0, err
+		}
+
+		n, err := strconv.Atoi(s)
+		if err == nil {
+			return n, nil
+		}
+
+		ask = errNotANumber + "\n" + question
+	}
+}
+
+// stdinIsTerminal returns whether the answers are typed in a terminal
+// rather than piped in, the full screen interface needs a terminal
+func stdinIsTerminal() bool {
+	fi, err := os.Stdin.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
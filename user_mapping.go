@@ -3,7 +3,6 @@ package main
 import (
 	"encoding/csv"
 	"fmt"
-	"log"
 	"os"
 	"path/filepath"
 
@@ -22,71 +21,88 @@ type UserMap struct {
 
 	GenerateCSV bool
 	Mapping     map[string]string
+
+	// The trello members the csv maps to the backup user
+	// as their clubhouse email is blank or not found
+	Fallbacks map[string]bool
 }
 
 // NewUserMap initializes a UserMap struct with trello and clubhouse members
-func NewUserMap(to *TrelloOptions, co *ClubhouseOptions) *UserMap {
+func NewUserMap(trelloMembers *[]trello.Member, co *ClubhouseOptions) (*UserMap, error) {
 	var um UserMap
+	var err error
+
+	um.TrelloMembers = trelloMembers
+	um.ClubhouseMembers, err = co.ListMembers()
+	if err != nil {
+		return nil, err
+	}
 
-	um.TrelloMembers = to.ListMembers()
-	um.ClubhouseMembers = co.ListMembers()
 	um.BackupUserID = co.ImportMember.ID
 	um.Mapping = make(map[string]string)
+	um.Fallbacks = make(map[string]bool)
 
-	return &um
+	return &um, nil
 }
 
 // SetupUserMapping calls all the internal prompt functions
-func (um *UserMap) SetupUserMapping() {
-	um.promptShouldGenerateCSV()
+func (um *UserMap) SetupUserMapping() error {
+	if err := um.promptShouldGenerateCSV(); err != nil {
+		return err
+	}
 
 	if um.GenerateCSV {
-		um.buildUserMapToFile()
-		fmt.Printf("*********************\n CSV generated: %s\n*********************\n", getCSVPath())
+		if err := um.GenerateUserMapCSV(); err != nil {
+			return err
+		}
 	}
 
-	um.promptReadyToReadCSV()
-	um.buildUserMapFromCSV()
-}
-
-func (um *UserMap) promptReadyToReadCSV() {
-
-	fmt.Println("Is your CSV user mapping correct ?")
-	fmt.Printf("CSV file: %s\n", getCSVPath())
-	fmt.Printf("Are you ready to continue ?\n[1] Yes\n")
+	if err := um.promptReadyToReadCSV(); err != nil {
+		return err
+	}
 
-	i := promptUserSelectResource()
+	return um.buildUserMapFromCSV()
+}
 
-	if i != 1 {
-		// If not 1 then call itself again
-		um.promptReadyToReadCSV()
+func (um *UserMap) promptReadyToReadCSV() error {
+	for {
+		yes, err := promptUserYesNo("Is your CSV user mapping correct ?\n" +
+			"CSV file: " + getCSVPath() + "\n" +
+			"Are you ready to continue ?")
+		if err != nil || yes {
+			return err
+		}
 	}
 }
 
-func (um *UserMap) promptShouldGenerateCSV() {
-	fmt.Println("To correctly map ticket owners to Clubhouse we need a user mapping CSV.")
-	fmt.Println("If this is the first time running this program you need to generate one.")
-	fmt.Println("We generate a csv of a best guess user mapping which you can edit to be correct")
-
-	fmt.Println("If you already have one that is correct please select option 1")
-
-	fmt.Println("Please select your option based on the above information:")
-
-	for i, b := range yesNoOpts {
-		fmt.Printf("[%d] %s\n", i, b)
+func (um *UserMap) promptShouldGenerateCSV() error {
+	yes, err := promptUserYesNo("To correctly map ticket owners to Clubhouse we need a user mapping CSV.\n" +
+		"If this is the first time running this program you need to generate one.\n" +
+		"We generate a csv of a best guess user mapping which you can edit to be correct\n" +
+		"If you already have one that is correct please select option 1\n" +
+		"Please select your option based on the above information:")
+	if err != nil {
+		return err
 	}
 
-	i := promptUserSelectResource()
-	if i >= len(yesNoOpts) {
-		log.Fatal(errOutOfRange)
+	if yes {
+		um.GenerateCSV = true
 	}
 
-	if i == 0 {
-		um.GenerateCSV = true
+	return nil
+}
+
+// GenerateUserMapCSV writes the best guess user mapping csv
+func (um UserMap) GenerateUserMapCSV() error {
+	if err := um.buildUserMapToFile(); err != nil {
+		return err
 	}
+
+	fmt.Printf("*********************\n CSV generated: %s\n*********************\n", getCSVPath())
+	return nil
 }
 
-func (um UserMap) buildUserMapToFile() {
+func (um UserMap) buildUserMapToFile() error {
 	var users = [][]string{{"TrelloUser", "ClubhouseEmail"}}
 
 	// Try best guess mapping for csv output
@@ -107,14 +123,45 @@ func (um UserMap) buildUserMapToFile() {
 		}
 	}
 
-	um.writeUserMapCSV(users)
+	return um.writeUserMapCSV(users)
+}
+
+// guessClubhouseMember returns the clubhouse member with the same name
+// as the trello member or nil when there isn't one
+func (um UserMap) guessClubhouseMember(m trello.Member) *ch.Member {
+	for i, u := range *um.ClubhouseMembers {
+		if m.FullName == u.Profile.Name {
+			return &(*um.ClubhouseMembers)[i]
+		}
+	}
+
+	return nil
+}
+
+// writeMappingCSV writes the current mapping to the user mapping csv
+// so the next run can read it instead of mapping the users again
+func (um UserMap) writeMappingCSV() error {
+	var users = [][]string{{"TrelloUser", "ClubhouseEmail"}}
+
+	for _, m := range *um.TrelloMembers {
+		var email string
+		for _, u := range *um.ClubhouseMembers {
+			if u.ID == um.Mapping[m.Id] {
+				email = u.Profile.EmailAddress
+			}
+		}
+
+		users = append(users, []string{m.Username, email})
+	}
+
+	return um.writeUserMapCSV(users)
 }
 
-func (um UserMap) writeUserMapCSV(users [][]string) {
+func (um UserMap) writeUserMapCSV(users [][]string) error {
 	f, err := os.Create(getCSVPath())
 
 	if err != nil {
-		log.Fatalf("Error creating user mapping file: %s", err)
+		return fmt.Errorf("creating user mapping file: %s", err)
 	}
 
 	defer f.Close()
@@ -123,22 +170,26 @@ func (um UserMap) writeUserMapCSV(users [][]string) {
 	err = w.WriteAll(users)
 
 	if err != nil {
-		log.Fatalf("Error writing contents to file: %s", err)
+		return fmt.Errorf("writing contents to file: %s", err)
 	}
+
+	return nil
 }
 
-func (um *UserMap) buildUserMapFromCSV() {
+func (um *UserMap) buildUserMapFromCSV() error {
 	f, err := os.Open(getCSVPath())
 
 	if err != nil {
-		log.Fatalf("Error opening user mapping file: %s", err)
+		return fmt.Errorf("opening user mapping file: %s", err)
 	}
 
+	defer f.Close()
+
 	r := csv.NewReader(f)
 
 	users, err := r.ReadAll()
 	if err != nil {
-		log.Fatalf("Error reading user mapping file: %s", err)
+		return fmt.Errorf("reading user mapping file: %s", err)
 	}
 
 	for i, u := range users {
@@ -151,21 +202,27 @@ func (um *UserMap) buildUserMapFromCSV() {
 		// OR the username is blank ignore
 		if len(u) != 2 || u[0] != "" {
 			tm := um.getTrelloMemberID(u[0])
-			cu := um.getClubhouseUserID(u[1])
+			cu, found := um.getClubhouseUserID(u[1])
 			um.Mapping[tm] = cu
+
+			if !found {
+				um.Fallbacks[tm] = true
+			}
 		}
 	}
+
+	return nil
 }
 
-func (um UserMap) getClubhouseUserID(email string) string {
+func (um UserMap) getClubhouseUserID(email string) (string, bool) {
 	for _, u := range *um.ClubhouseMembers {
-		if u.Profile.EmailAddress == email {
-			return u.ID
+		if email != "" && u.Profile.EmailAddress == email {
+			return u.ID, true
 		}
 	}
 
 	// If we get here no match found fallback to import user
-	return um.BackupUserID
+	return um.BackupUserID, false
 }
 
 func (um UserMap) getTrelloMemberID(username string) string {
@@ -180,13 +237,18 @@ func (um UserMap) getTrelloMemberID(username string) string {
 }
 
 func getCSVPath() string {
+	return getWorkingDirFilePath(csvFile)
+}
+
+func getWorkingDirFilePath(name string) string {
 	p, err := os.Getwd()
 
 	if err != nil {
-		log.Fatalf("Failed to get current directory: %s", err)
+		// Relative to the current directory is the best we can do
+		return name
 	}
 
-	return filepath.Join(p, csvFile)
+	return filepath.Join(p, name)
 }
 
 // GetCreator returns the item from the user mapping
@@ -200,3 +262,59 @@ func (um UserMap) GetCreator(id string) string {
 
 	return u
 }
+
+// GetMemberName returns the clubhouse name for the trello member id
+// or the fallback when the member isn't mapped
+func (um UserMap) GetMemberName(id string, fallback string) string {
+	u := um.Mapping[id]
+
+	for _, m := range *um.ClubhouseMembers {
+		if u != "" && m.ID == u {
+			return m.Profile.Name
+		}
+	}
+
+	return fallback
+}
+
+// UnmappedUsersForCard returns the usernames of the trello members on the card
+// which have no user mapping or a csv row without a clubhouse user, so fall back
+// to the backup user
+func (um UserMap) UnmappedUsersForCard(card *Card) []string {
+	ids := []string{card.IDCreator}
+	ids = append(ids, card.IDOwners...)
+	ids = append(ids, card.IDFollowers...)
+
+	for _, cm := range card.Comments {
+		ids = append(ids, cm.IDCreator)
+	}
+
+	for _, t := range card.Tasks {
+		ids = append(ids, t.IDOwner)
+	}
+
+	var users []string
+	seen := map[string]bool{}
+
+	for _, id := range ids {
+		if id == "" || seen[id] || (um.Mapping[id] != "" && !um.Fallbacks[id]) {
+			continue
+		}
+
+		seen[id] = true
+		users = append(users, um.getTrelloUsername(id))
+	}
+
+	return users
+}
+
+func (um UserMap) getTrelloUsername(id string) string {
+	for _, m := range *um.TrelloMembers {
+		if m.Id == id {
+			return m.Username
+		}
+	}
+
+	// Not a member of the board anymore so fall back to the id
+	return id
+}
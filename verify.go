@@ -0,0 +1,305 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	ch "github.com/jnormington/clubhouse-go"
+)
+
+var urlRegexp = regexp.MustCompile(`https?://\S+`)
+
+// verifyCard holds the parts of the trello card the story is compared with
+type verifyCard struct {
+	Name        string      `json:"name"`
+	Desc        string      `json:"desc"`
+	Due         string      `json:"due"`
+	DueComplete bool        `json:"dueComplete"`
+	IDMembers   []string    `json:"idMembers"`
+	Labels      []Label     `json:"labels"`
+	Checklists  []checklist `json:"checklists"`
+	Attachments []struct {
+		Name string `json:"name"`
+	} `json:"attachments"`
+	Actions []struct {
+		Type string `json:"type"`
+	} `json:"actions"`
+	Board struct {
+		Name string `json:"name"`
+	} `json:"board"`
+	List struct {
+		Name string `json:"name"`
+	} `json:"list"`
+}
+
+// cardVerifier compares the stories with their trello cards mapped
+// with the options, user mapping and export rules used by the run
+type cardVerifier struct {
+	opts          *ClubhouseOptions
+	users         *UserMap
+	rules         LabelRules
+	patterns      []EstimatePattern
+	processImages bool
+}
+
+// RunVerify re-reads every story created by a run and its trello card,
+// recording a card error for every difference between them
+func RunVerify(args []string) error {
+	fs := newFlagSet("verify", "<run-id>")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+
+	rl, err := LoadRunLog(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	v, err := newCardVerifier(rl)
+	if err != nil {
+		return err
+	}
+
+	c := ch.New(clubHouseToken)
+
+	fmt.Printf("Verifying %d stories from run %s...\n", len(rl.Imported), rl.RunID)
+	fmt.Printf(outputFormat+"\n", "Trello Card Link", "Verify Status", "Mismatches")
+
+	var failed int
+	for _, ic := range rl.Imported {
+		st, err := c.GetStory(ic.StoryID)
+		if err != nil {
+			failed++
+			fmt.Printf(outputFormat, ic.TrelloURL, "Failed", err)
+			failures.Add(stageVerify, ic.Name, ic.TrelloURL, err)
+			continue
+		}
+
+		card, err := getVerifyCard(ic.TrelloURL)
+		if err != nil {
+			failed++
+			fmt.Printf(outputFormat, ic.TrelloURL, "Failed", err)
+			failures.Add(stageVerify, ic.Name, ic.TrelloURL, err)
+			continue
+		}
+
+		mismatches := v.compareStory(card, &ic, &st)
+		if len(mismatches) > 0 {
+			failed++
+			fmt.Printf(outputFormat, ic.TrelloURL, "Mismatch", strings.Join(mismatches, "; "))
+			failures.Add(stageVerify, ic.Name, ic.TrelloURL, errors.New(strings.Join(mismatches, "; ")))
+			continue
+		}
+
+		fmt.Printf(outputFormat, ic.TrelloURL, "OK", fmt.Sprintf("Story ID: %d", ic.StoryID))
+	}
+
+	if failed > 0 {
+		fmt.Printf("%d of %d stories failed verification\n", failed, len(rl.Imported))
+		return nil
+	}
+
+	fmt.Println("All stories verified")
+	return nil
+}
+
+// newCardVerifier uses the options, user mapping and export rules recorded by the run
+func newCardVerifier(rl *RunLog) (*cardVerifier, error) {
+	if rl.Options == nil || rl.Users == nil {
+		return nil, fmt.Errorf("the run log for %s has no options or user mapping to verify with", rl.RunID)
+	}
+
+	return &cardVerifier{
+		opts:          rl.Options,
+		users:         rl.Users,
+		rules:         rl.LabelRules,
+		patterns:      rl.EstimatePatterns,
+		processImages: rl.ProcessImages,
+	}, nil
+}
+
+// getVerifyCard queries the card by the short link at the end of its url
+func getVerifyCard(trelloURL string) (*verifyCard, error) {
+	params := url.Values{}
+	params.Set("fields", "name,desc,due,dueComplete,idMembers,labels")
+	params.Set("checklists", "all")
+	params.Set("attachments", "true")
+	params.Set("attachment_fields", "name")
+	params.Set("actions", "commentCard")
+	params.Set("actions_limit", "1000")
+	params.Set("board", "true")
+	params.Set("board_fields", "name")
+	params.Set("list", "true")
+	params.Set("list_fields", "name")
+
+	var c verifyCard
+	if err := getTrelloResource("/cards/"+path.Base(trelloURL), params, &c); err != nil {
+		return nil, fmt.Errorf("querying the trello card: %s", err)
+	}
+
+	return &c, nil
+}
+
+// compareStory returns a description of every attribute of
+// the created story which doesn't match its trello card
+func (v *cardVerifier) compareStory(card *verifyCard, ic *ImportedCard, got *ch.Story) []string {
+	var m []string
+
+	name := card.Name
+	if name != got.Name {
+		// The points syntax is stripped when the estimates were parsed
+		name, _ = parseEstimateFromName(card.Name, v.patterns)
+	}
+
+	if name != got.Name {
+		m = append(m, fmt.Sprintf("name %q != %q", got.Name, card.Name))
+	}
+
+	// Attachment links may have been rewritten to the migrated files
+	desc := strings.TrimSpace(urlRegexp.ReplaceAllString(card.Desc, ""))
+	if !strings.Contains(urlRegexp.ReplaceAllString(got.Description, ""), desc) {
+		m = append(m, "description differs")
+	}
+
+	due := parseDateOrReturnNil(card.Due)
+	if card.DueComplete && v.opts.DropCompletedDeadline {
+		due = nil
+	}
+
+	if (due == nil) != (got.Deadline == nil) || (due != nil && !due.Equal(*got.Deadline)) {
+		m = append(m, "deadline differs")
+	}
+
+	var owners []string
+	for _, id := range card.IDMembers {
+		owners = append(owners, v.users.GetCreator(id))
+	}
+
+	// Unmapped members all fall back to the backup user so compare without duplicates
+	if !sameStrings(uniqueStrings(owners), uniqueStrings(got.OwnerIds)) {
+		m = append(m, fmt.Sprintf("owners %v != %v", uniqueStrings(got.OwnerIds), uniqueStrings(owners)))
+	}
+
+	if missing := v.missingLabels(card, got); len(missing) > 0 {
+		m = append(m, fmt.Sprintf("labels missing %v", missing))
+	}
+
+	tasks, completed := v.expectedTasks(card)
+	if tasks != len(got.Tasks) {
+		m = append(m, fmt.Sprintf("tasks %d != %d", len(got.Tasks), tasks))
+	} else if completed != countCompleted(got.Tasks) {
+		m = append(m, fmt.Sprintf("completed tasks %d != %d", countCompleted(got.Tasks), completed))
+	}
+
+	if n := countTrelloComments(got.Comments); n != len(card.Actions) {
+		m = append(m, fmt.Sprintf("comments %d != %d", n, len(card.Actions)))
+	}
+
+	if v.processImages && len(card.Attachments) != len(got.LinkedFileIds) {
+		m = append(m, fmt.Sprintf("linked files %d != %d", len(got.LinkedFileIds), len(card.Attachments)))
+	}
+
+	return m
+}
+
+// missingLabels returns the labels of the card, named and rewritten
+// as the import does, which aren't on the story
+func (v *cardVerifier) missingLabels(card *verifyCard, got *ch.Story) []string {
+	labels := card.Labels
+	if len(v.rules) > 0 {
+		labels = v.rules.Apply(labels, card.Board.Name, card.List.Name)
+	}
+
+	onStory := map[string]bool{}
+	for _, l := range got.Labels {
+		onStory[strings.ToLower(l.Name)] = true
+	}
+
+	var missing []string
+	for _, l := range labels {
+		name := v.opts.LabelName(l)
+		if _, ok := v.opts.LabelEpics[name]; ok && v.opts.RemoveEpicLabels {
+			continue
+		}
+
+		if !onStory[strings.ToLower(name)] {
+			missing = append(missing, name)
+		}
+	}
+
+	return missing
+}
+
+// expectedTasks returns the number of checklist items and completed items
+// imported as tasks, leaving out the checklists imported as stories
+func (v *cardVerifier) expectedTasks(card *verifyCard) (int, int) {
+	var tasks, completed int
+
+	for _, cl := range card.Checklists {
+		if v.opts.ChecklistThreshold > 0 && len(cl.CheckItems) > v.opts.ChecklistThreshold {
+			continue
+		}
+
+		for _, i := range cl.CheckItems {
+			tasks++
+			if i.State == "complete" {
+				completed++
+			}
+		}
+	}
+
+	return tasks, completed
+}
+
+func countCompleted(tasks []ch.Task) int {
+	var n int
+	for _, t := range tasks {
+		if t.Complete {
+			n++
+		}
+	}
+
+	return n
+}
+
+func uniqueStrings(a []string) []string {
+	var u []string
+	seen := map[string]bool{}
+
+	for _, s := range a {
+		if !seen[s] {
+			seen[s] = true
+			u = append(u, s)
+		}
+	}
+
+	return u
+}
+
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	a = append([]string{}, a...)
+	b = append([]string{}, b...)
+	sort.Strings(a)
+	sort.Strings(b)
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}